@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 
 	"github.com/datapeice/astolfosplayer-backend/internal/auth"
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
 	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
@@ -21,19 +26,76 @@ func main() {
 	}
 
 	// Auto-migrate the schema
-	if err := database.AutoMigrate(&auth.User{}); err != nil {
+	if err := database.AutoMigrate(&auth.User{}, &auth.Device{}, &auth.Session{}, &auth.IssuedToken{}, &auth.RefreshToken{}, &auth.Invite{}); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+	if err := auth.EnsureAdmin(database); err != nil {
+		log.Fatalf("Failed to set up admin: %v", err)
+	}
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
+	var signer auth.Signer
+	var verifier auth.Verifier
+	if cfg.SigningAlgorithm == auth.AlgHS256 {
+		if cfg.SecretKey == "" {
+			log.Fatalf("SECRET_KEY is required for HS256 signing")
+		}
+		signer, verifier = auth.Secret(cfg.SecretKey), auth.Secret(cfg.SecretKey)
+	} else {
+		keys, err := auth.OpenKeyStore(cfg.KeyDir, cfg.SigningAlgorithm)
+		if err != nil {
+			log.Fatalf("Failed to open key store: %v", err)
+		}
+		keys.Legacy = auth.Secret(cfg.SecretKey)
+		go keys.Run(context.Background(), cfg.KeyRefreshInterval)
+		signer, verifier = keys, keys
+	}
+
+	if cfg.JWKSPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/.well-known/jwks.json", auth.JWKSHandler(signer))
+		go func() {
+			log.Printf("Serving JWKS on :%s", cfg.JWKSPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%s", cfg.JWKSPort), mux); err != nil {
+				log.Fatalf("Failed to serve JWKS: %v", err)
+			}
+		}()
+	}
+
+	denylist := auth.NewDenylist(auth.LocalRevocations(database))
+	go denylist.Run(context.Background(), cfg.RevocationInterval)
+
+	// Everything but signing up, logging in and refreshing needs a token;
+	// the other services fetch public keys without one and revoked tokens
+	// with the service token
+	if cfg.ServiceToken == "" {
+		log.Printf("SERVICE_TOKEN is not set, the other services cannot fetch revoked tokens")
+	}
+	authInterceptor := interceptor.NewAuthInterceptor(verifier,
+		pb.AuthService_Register_FullMethodName,
+		pb.AuthService_Login_FullMethodName,
+		pb.AuthService_Refresh_FullMethodName,
+		pb.AuthService_GetRevokedTokens_FullMethodName,
+		pb.AuthService_GetPublicKeys_FullMethodName,
+	).WithDenylist(denylist)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(authInterceptor.Unary()),
+		grpc.StreamInterceptor(authInterceptor.Stream()),
+	)
+	fileConn, err := grpc.NewClient(cfg.FileAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to create File service client: %v", err)
+	}
 	pb.RegisterAuthServiceServer(s, &auth.Server{
-		DB:     database,
-		Config: cfg,
+		DB:       database,
+		Config:   cfg,
+		Signer:   signer,
+		Denylist: denylist,
+		Files:    filepb.NewFileServiceClient(fileConn),
 	})
 
 	log.Printf("Auth Service listening on :%s", cfg.Port)
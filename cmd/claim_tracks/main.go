@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/config"
+	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+)
+
+// Assigns tracks uploaded before per-user libraries existed to a user.
+func main() {
+	username := flag.String("user", "", "Username that should own unclaimed tracks")
+	flag.Parse()
+
+	if *username == "" {
+		log.Fatalf("-user is required")
+	}
+
+	cfg := config.LoadFileConfig()
+
+	database, err := db.Connect(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	if err := database.AutoMigrate(&file.LibraryEntry{}, &file.Blob{}, &file.Change{}); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	var tracks []file.Track
+	err = database.Where("hash NOT IN (?)", database.Unscoped().Model(&file.LibraryEntry{}).Select("hash")).Find(&tracks).Error
+	if err != nil {
+		log.Fatalf("Failed to fetch tracks: %v", err)
+	}
+
+	for _, track := range tracks {
+		if _, err := file.AddToLibrary(database, *username, track.Hash); err != nil {
+			log.Printf("Failed to claim %s: %v\n", track.Hash, err)
+			continue
+		}
+		fmt.Printf("Claimed %s (%s)\n", track.Hash, track.Filename)
+	}
+
+	if err := file.ReconcileBlobs(database); err != nil {
+		log.Fatalf("Failed to reconcile blob references: %v", err)
+	}
+
+	fmt.Printf("Done. Assigned %d tracks to %s.\n", len(tracks), *username)
+}
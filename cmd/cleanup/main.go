@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
@@ -14,6 +16,9 @@ import (
 )
 
 func main() {
+	// Services require a token issued by the Auth service
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+os.Getenv("AUTH_TOKEN"))
+
 	// Connect to Sync Service
 	syncConn, err := grpc.NewClient("localhost:50053", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -31,7 +36,7 @@ func main() {
 	fileClient := filepb.NewFileServiceClient(fileConn)
 
 	// Get all hashes
-	resp, err := syncClient.GetSync(context.Background(), &emptypb.Empty{})
+	resp, err := syncClient.GetSync(ctx, &emptypb.Empty{})
 	if err != nil {
 		log.Fatalf("Failed to get sync: %v", err)
 	}
@@ -41,10 +46,11 @@ func main() {
 		"220a7cc4fa56a6a7d0859d97073032e4b943c7f44e8d1f9ad4e129dc926ae4a5": true,
 	}
 
-	for _, hash := range resp.Hashes {
+	for _, f := range resp.Files {
+		hash := f.Hash
 		if !existingHashes[hash] {
 			fmt.Printf("Deleting missing hash: %s\n", hash)
-			_, err := fileClient.Delete(context.Background(), &filepb.DeleteRequest{Hash: hash})
+			_, err := fileClient.Delete(ctx, &filepb.DeleteRequest{Hash: hash})
 			if err != nil {
 				log.Printf("Failed to delete %s: %v\n", hash, err)
 			} else {
@@ -6,11 +6,15 @@ import (
 	"log"
 	"net"
 
+	"github.com/datapeice/astolfosplayer-backend/internal/auth"
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
 	"github.com/datapeice/astolfosplayer-backend/internal/db"
 	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	authpb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
@@ -23,10 +27,14 @@ func main() {
 	}
 
 	// Auto-migrate
-	if err := database.AutoMigrate(&file.Track{}); err != nil {
+	if err := database.AutoMigrate(&file.Track{}, &file.LibraryEntry{}, &file.Blob{}, &file.UploadSession{}, &file.Artwork{}, &file.Change{}, &file.ChangeLogState{}); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
+	if err := file.ReconcileBlobs(database); err != nil {
+		log.Fatalf("Failed to reconcile blob references: %v", err)
+	}
+
 	// Connect to MinIO
 	minioClient, err := file.NewMinioClient(cfg.S3Endpoint, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3UseSSL)
 	if err != nil {
@@ -38,17 +46,72 @@ func main() {
 		log.Fatalf("Failed to ensure bucket exists: %v", err)
 	}
 
+	// Tracks uploaded before content sniffing have no format yet
+	go func() {
+		detected, err := file.DetectFormats(context.Background(), database, minioClient, cfg.S3Bucket)
+		if err != nil {
+			log.Printf("Format detection failed: %v", err)
+		}
+		if detected > 0 {
+			log.Printf("Detected the format of %d existing tracks", detected)
+		}
+	}()
+
+	collector := &file.Collector{
+		DB:          database,
+		MinioClient: minioClient,
+		Bucket:      cfg.S3Bucket,
+		Interval:    cfg.GCInterval,
+		GracePeriod: cfg.GCGracePeriod,
+	}
+	go collector.Run(context.Background())
+	go file.RunChangeCompactor(context.Background(), database, cfg.GCInterval, cfg.ChangeRetention)
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	pb.RegisterFileServiceServer(s, &file.Server{
+	// Public keys and revoked tokens are cached so calls do not wait on the
+	// Auth service
+	authConn, err := grpc.NewClient(cfg.AuthAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to create Auth service client: %v", err)
+	}
+	authClient := authpb.NewAuthServiceClient(authConn)
+	keys := auth.NewKeySet(auth.RemotePublicKeys(authClient))
+	switch {
+	case cfg.AcceptLegacyHS256 && cfg.SecretKey == "":
+		log.Fatalf("SECRET_KEY is required with ACCEPT_LEGACY_HS256")
+	case cfg.AcceptLegacyHS256:
+		log.Printf("Warning: ACCEPT_LEGACY_HS256 is deprecated; anyone holding SECRET_KEY, including this service, can mint tokens it accepts")
+		keys.Legacy = auth.Secret(cfg.SecretKey)
+	case cfg.SecretKey != "":
+		log.Printf("SECRET_KEY is ignored without ACCEPT_LEGACY_HS256, remove it from this service")
+	}
+	go keys.Run(context.Background(), cfg.KeyRefreshInterval)
+	if cfg.ServiceToken == "" {
+		log.Printf("SERVICE_TOKEN is not set, revoked tokens cannot be fetched from the Auth service")
+	}
+	denylist := auth.NewDenylist(auth.RemoteRevocations(authClient, cfg.ServiceToken))
+	go denylist.Run(context.Background(), cfg.RevocationInterval)
+
+	authInterceptor := interceptor.NewAuthInterceptor(keys).WithDenylist(denylist).WithGuestMethods(
+		pb.FileService_Download_FullMethodName,
+		pb.FileService_CheckHashes_FullMethodName,
+		pb.FileService_GetArtwork_FullMethodName,
+	)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(authInterceptor.Unary()),
+		grpc.StreamInterceptor(authInterceptor.Stream()),
+	)
+	server := &file.Server{
 		MinioClient: minioClient,
 		DB:          database,
 		Config:      cfg,
-	})
+	}
+	go server.RunUploadJanitor(context.Background(), cfg.GCInterval)
+	pb.RegisterFileServiceServer(s, server)
 
 	log.Printf("File Service listening on :%s", cfg.Port)
 	if err := s.Serve(lis); err != nil {
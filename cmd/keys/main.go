@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/auth"
+	"github.com/datapeice/astolfosplayer-backend/internal/config"
+)
+
+// Manages the signing keys of the Auth service in KEY_DIR. A running Auth
+// service picks up changes within KEY_REFRESH_INTERVAL.
+//
+//	keys list
+//	keys rotate [-alg EdDSA|RS256]
+//	keys remove <kid>
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: keys list|rotate|remove [flags]")
+	}
+
+	cfg := config.LoadAuthConfig()
+	if cfg.SigningAlgorithm == auth.AlgHS256 {
+		log.Fatalf("SIGNING_ALG is HS256, tokens are signed with SECRET_KEY")
+	}
+	keys, err := auth.OpenKeyStore(cfg.KeyDir, cfg.SigningAlgorithm)
+	if err != nil {
+		log.Fatalf("Failed to open key store: %v", err)
+	}
+
+	switch os.Args[1] {
+	case "list":
+		for i, key := range keys.Keys() {
+			role := "verifies"
+			if i == 0 {
+				role = "signs"
+			}
+			fmt.Printf("%s  %-5s  %s  %s\n", key.ID, key.Algorithm, key.Created.Format(time.RFC3339), role)
+		}
+	case "rotate":
+		flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+		algorithm := flags.String("alg", cfg.SigningAlgorithm, "EdDSA or RS256")
+		flags.Parse(os.Args[2:])
+
+		key, err := keys.Rotate(*algorithm)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		fmt.Printf("Generated %s key %s, remove the previous key once its tokens expired (ACCESS_TOKEN_TTL)\n", key.Algorithm, key.ID)
+	case "remove":
+		if len(os.Args) != 3 {
+			log.Fatalf("usage: keys remove <kid>")
+		}
+		if err := keys.Remove(os.Args[2]); err != nil {
+			log.Fatalf("Failed to remove key: %v", err)
+		}
+		fmt.Printf("Removed key %s\n", os.Args[2])
+	default:
+		log.Fatalf("unknown command %q, expected list, rotate or remove", os.Args[1])
+	}
+}
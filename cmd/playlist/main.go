@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/config"
+	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/playlist"
+	"gorm.io/gorm"
+)
+
+// Imports playlist files from other players into a user's playlists and
+// exports them again, working on the database directly.
+//
+//	playlist import -user <name> [-name <playlist>] [-format m3u|pls|xspf] <file>
+//	playlist export -user <name> -playlist <id> [-format m3u|pls|xspf] [-url <prefix>] [-o <file>]
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: playlist import|export [flags]")
+	}
+
+	cfg := config.LoadSyncConfig()
+
+	database, err := db.Connect(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	if err := database.AutoMigrate(&playlist.Playlist{}, &playlist.Item{}, &file.Change{}); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	switch os.Args[1] {
+	case "import":
+		importPlaylist(database, os.Args[2:])
+	case "export":
+		exportPlaylist(database, os.Args[2:])
+	default:
+		log.Fatalf("unknown command %q, expected import or export", os.Args[1])
+	}
+}
+
+func importPlaylist(database *gorm.DB, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("user", "", "Username that should own the playlist")
+	name := flags.String("name", "", "Playlist name, defaults to the title in the file")
+	formatName := flags.String("format", "", "m3u, pls or xspf, defaults to the file extension")
+	flags.Parse(args)
+
+	if *username == "" || flags.NArg() != 1 {
+		log.Fatalf("-user and a playlist file are required")
+	}
+	path := flags.Arg(0)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	format, ok := playlist.FormatFromExtension(path)
+	if *formatName != "" {
+		format = parseFormat(*formatName)
+	} else if !ok {
+		format = playlist.DetectFormat(data)
+	}
+
+	resp, err := playlist.Import(database, *username, *name, format, data)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", path, err)
+	}
+
+	for _, e := range resp.Unmatched {
+		if e.Title == "" {
+			fmt.Printf("Unmatched #%d: %s\n", e.Index+1, e.Location)
+			continue
+		}
+		fmt.Printf("Unmatched #%d: %s (%s - %s)\n", e.Index+1, e.Location, e.Artist, e.Title)
+	}
+	fmt.Printf("Created playlist %s (%s): %d matched by filename, %d by tags, %d unmatched.\n",
+		resp.Playlist.Name, resp.Playlist.PlaylistId, resp.MatchedByFilename, resp.MatchedByTags, len(resp.Unmatched))
+}
+
+func exportPlaylist(database *gorm.DB, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	username := flags.String("user", "", "Username that owns the playlist")
+	playlistID := flags.String("playlist", "", "ID of the playlist to export")
+	formatName := flags.String("format", string(playlist.FormatM3U), "m3u, pls or xspf")
+	urlPrefix := flags.String("url", "", "Reference tracks as this prefix followed by the content hash instead of by filename")
+	output := flags.String("o", "", "Output file, defaults to stdout")
+	flags.Parse(args)
+
+	if *username == "" || *playlistID == "" {
+		log.Fatalf("-user and -playlist are required")
+	}
+
+	resp, err := playlist.Export(database, *username, *playlistID, parseFormat(*formatName), *urlPrefix)
+	if err != nil {
+		log.Fatalf("Failed to export playlist: %v", err)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(resp.Data)
+		return
+	}
+	if err := os.WriteFile(*output, resp.Data, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	fmt.Printf("Wrote %s\n", *output)
+}
+
+func parseFormat(name string) playlist.Format {
+	format, ok := playlist.FormatFromExtension("." + name)
+	if !ok {
+		log.Fatalf("unknown format %q, expected m3u, pls or xspf", name)
+	}
+	return format
+}
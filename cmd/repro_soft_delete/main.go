@@ -6,15 +6,20 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 
 	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 )
 
 func main() {
+	// Services require a token issued by the Auth service
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+os.Getenv("AUTH_TOKEN"))
+
 	conn, err := grpc.NewClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
@@ -30,12 +35,12 @@ func main() {
 
 	// 1. Upload
 	fmt.Println("1. Uploading...")
-	upload(client, content, "test.txt")
+	upload(ctx, client, content, "test.txt")
 	fmt.Println("   Uploaded.")
 
 	// 2. Delete
 	fmt.Println("2. Deleting...")
-	_, err = client.Delete(context.Background(), &filepb.DeleteRequest{Hash: hash})
+	_, err = client.Delete(ctx, &filepb.DeleteRequest{Hash: hash})
 	if err != nil {
 		log.Fatalf("Failed to delete: %v", err)
 	}
@@ -43,12 +48,12 @@ func main() {
 
 	// 3. Upload again (should succeed now)
 	fmt.Println("3. Uploading again...")
-	upload(client, content, "test.txt")
+	upload(ctx, client, content, "test.txt")
 	fmt.Println("   Uploaded again successfully.")
 }
 
-func upload(client filepb.FileServiceClient, content []byte, filename string) {
-	stream, err := client.Upload(context.Background())
+func upload(ctx context.Context, client filepb.FileServiceClient, content []byte, filename string) {
+	stream, err := client.Upload(ctx)
 	if err != nil {
 		log.Fatalf("Failed to start upload: %v", err)
 	}
@@ -6,15 +6,20 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 
 	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 )
 
 func main() {
+	// Services require a token issued by the Auth service
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+os.Getenv("AUTH_TOKEN"))
+
 	// Connect to File Service
 	conn, err := grpc.NewClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -31,7 +36,7 @@ func main() {
 	fmt.Printf("Uploading file with hash: %s\n", hash)
 
 	// Start Upload
-	stream, err := client.Upload(context.Background())
+	stream, err := client.Upload(ctx)
 	if err != nil {
 		log.Fatalf("Failed to start upload: %v", err)
 	}
@@ -45,6 +50,8 @@ func main() {
 				Artist:   "Tester",
 				Album:    "Reproduction",
 				Duration: 10,
+				Sha256:   hash,
+				Size:     int64(len(content)),
 			},
 		},
 	})
@@ -79,7 +86,7 @@ func main() {
 
 	// Try to Download
 	fmt.Println("Attempting to download...")
-	downStream, err := client.Download(context.Background(), &filepb.DownloadRequest{Hash: hash})
+	downStream, err := client.Download(ctx, &filepb.DownloadRequest{Hash: hash})
 	if err != nil {
 		log.Fatalf("Failed to start download: %v", err)
 	}
@@ -93,7 +100,7 @@ func main() {
 			}
 			log.Fatalf("Failed to download chunk: %v", err)
 		}
-		recvContent = append(recvContent, chunk.Chunk...)
+		recvContent = append(recvContent, chunk.GetChunk()...)
 	}
 
 	if string(recvContent) != string(content) {
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"time"
 
+	"github.com/datapeice/astolfosplayer-backend/internal/auth"
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
 	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/playlist"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
 	"github.com/datapeice/astolfosplayer-backend/internal/sync"
+	authpb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	playlistpb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/playlist"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
@@ -20,15 +30,80 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Playlist edits are written to the change log shared with the File service
+	if err := database.AutoMigrate(&sync.DeviceState{}, &sync.DeviceTrack{}, &sync.SyncRule{}, &sync.DeviceSyncSettings{}, &sync.PlaybackState{}, &sync.Play{}, &sync.Annotation{}, &playlist.Playlist{}, &playlist.Item{}, &file.Change{}); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
+	// Public keys and revoked tokens are cached so calls do not wait on the
+	// Auth service
+	authConn, err := grpc.NewClient(cfg.AuthAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to create Auth service client: %v", err)
+	}
+	authClient := authpb.NewAuthServiceClient(authConn)
+	keys := auth.NewKeySet(auth.RemotePublicKeys(authClient))
+	switch {
+	case cfg.AcceptLegacyHS256 && cfg.SecretKey == "":
+		log.Fatalf("SECRET_KEY is required with ACCEPT_LEGACY_HS256")
+	case cfg.AcceptLegacyHS256:
+		log.Printf("Warning: ACCEPT_LEGACY_HS256 is deprecated; anyone holding SECRET_KEY, including this service, can mint tokens it accepts")
+		keys.Legacy = auth.Secret(cfg.SecretKey)
+	case cfg.SecretKey != "":
+		log.Printf("SECRET_KEY is ignored without ACCEPT_LEGACY_HS256, remove it from this service")
+	}
+	go keys.Run(context.Background(), cfg.KeyRefreshInterval)
+	if cfg.ServiceToken == "" {
+		log.Printf("SERVICE_TOKEN is not set, revoked tokens cannot be fetched from the Auth service")
+	}
+	denylist := auth.NewDenylist(auth.RemoteRevocations(authClient, cfg.ServiceToken))
+	go denylist.Run(context.Background(), cfg.RevocationInterval)
+
+	// Guests may read and still report what their devices store and play
+	authInterceptor := interceptor.NewAuthInterceptor(keys).WithDenylist(denylist).WithGuestMethods(
+		pb.SyncService_GetSync_FullMethodName,
+		pb.SyncService_GetChanges_FullMethodName,
+		pb.SyncService_WatchLibrary_FullMethodName,
+		pb.SyncService_ReportLocalTracks_FullMethodName,
+		pb.SyncService_ListDeviceStates_FullMethodName,
+		pb.SyncService_GetMissingTracks_FullMethodName,
+		pb.SyncService_GetSyncRules_FullMethodName,
+		pb.SyncService_ReportPlayback_FullMethodName,
+		pb.SyncService_GetPlayback_FullMethodName,
+		pb.SyncService_WatchPlayback_FullMethodName,
+		pb.SyncService_ReportPlays_FullMethodName,
+		pb.SyncService_GetTrackStats_FullMethodName,
+		pb.SyncService_GetTopCharts_FullMethodName,
+		pb.SyncService_GetYearSummary_FullMethodName,
+		pb.SyncService_ListAnnotations_FullMethodName,
+		playlistpb.PlaylistService_ListPlaylists_FullMethodName,
+		playlistpb.PlaylistService_GetPlaylist_FullMethodName,
+		playlistpb.PlaylistService_ExportPlaylist_FullMethodName,
+	)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(authInterceptor.Unary()),
+		grpc.StreamInterceptor(authInterceptor.Stream()),
+	)
+	// The File service runs in its own process, so its writes are picked up
+	// from the shared database
+	events := pubsub.NewBroker()
+	go sync.PollChanges(context.Background(), database, events, cfg.WatchPollInterval)
+	go playlist.RunSmartRefresher(context.Background(), database, events, cfg.SmartPlaylistInterval)
+	go sync.RunDeviceExpiry(context.Background(), database, time.Hour, cfg.DeviceStateTTL)
+
 	pb.RegisterSyncServiceServer(s, &sync.Server{
 		DB:     database,
 		Config: cfg,
+		Events: events,
+	})
+	playlistpb.RegisterPlaylistServiceServer(s, &playlist.Server{
+		DB:     database,
+		Events: events,
 	})
 
 	log.Printf("Sync Service listening on :%s", cfg.Port)
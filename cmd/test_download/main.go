@@ -5,14 +5,19 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 
 	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 )
 
 func main() {
+	// Services require a token issued by the Auth service
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+os.Getenv("AUTH_TOKEN"))
+
 	// Connect to File Service
 	fileConn, err := grpc.NewClient("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -26,7 +31,7 @@ func main() {
 	hash := "1c2e13c44278e45b29aec2e49c8e4d51b5b113fdedb816293d6a25f9fb2b3607"
 
 	fmt.Printf("Attempting to download hash: %s\n", hash)
-	stream, err := fileClient.Download(context.Background(), &filepb.DownloadRequest{Hash: hash})
+	stream, err := fileClient.Download(ctx, &filepb.DownloadRequest{Hash: hash})
 	if err != nil {
 		log.Fatalf("Failed to start download: %v", err)
 	}
@@ -40,7 +45,11 @@ func main() {
 		if err != nil {
 			log.Fatalf("Error receiving chunk: %v", err)
 		}
-		totalBytes += len(resp.Chunk)
+		if header := resp.GetHeader(); header != nil {
+			fmt.Printf("Size: %d bytes, type: %s, sending %d bytes from offset %d\n", header.TotalSize, header.ContentType, header.Length, header.Offset)
+			continue
+		}
+		totalBytes += len(resp.GetChunk())
 		fmt.Printf("\rReceived %d bytes...", totalBytes)
 	}
 	fmt.Printf("\nDownload complete! Total bytes: %d\n", totalBytes)
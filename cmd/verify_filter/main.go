@@ -4,16 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	syncpb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
 )
 
 func main() {
+	// Services require a token issued by the Auth service
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+os.Getenv("AUTH_TOKEN"))
+
 	conn, err := grpc.NewClient("localhost:50053", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("Failed to connect to Sync: %v", err)
@@ -21,7 +26,7 @@ func main() {
 	defer conn.Close()
 	client := syncpb.NewSyncServiceClient(conn)
 
-	resp, err := client.GetSync(context.Background(), &emptypb.Empty{})
+	resp, err := client.GetSync(ctx, &emptypb.Empty{})
 	if err != nil {
 		log.Fatalf("Failed to get sync: %v", err)
 	}
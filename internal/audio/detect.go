@@ -0,0 +1,215 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Format identifies the container and codec of an audio file.
+type Format string
+
+const (
+	FormatMP3    Format = "mp3"
+	FormatAAC    Format = "aac" // Raw ADTS stream
+	FormatM4A    Format = "m4a" // MP4 audio (AAC or ALAC)
+	FormatFLAC   Format = "flac"
+	FormatVorbis Format = "vorbis"
+	FormatOpus   Format = "opus"
+	FormatWAV    Format = "wav"
+	FormatWMA    Format = "wma"
+)
+
+var mimeTypes = map[Format]string{
+	FormatMP3:    "audio/mpeg",
+	FormatAAC:    "audio/aac",
+	FormatM4A:    "audio/mp4",
+	FormatFLAC:   "audio/flac",
+	FormatVorbis: "audio/ogg",
+	FormatOpus:   "audio/ogg",
+	FormatWAV:    "audio/wav",
+	FormatWMA:    "audio/x-ms-wma",
+}
+
+// MIMEType returns the media type files of this format are served with.
+func (f Format) MIMEType() string {
+	if t, ok := mimeTypes[f]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+var (
+	asfHeaderGUID           = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+	asfStreamPropertiesGUID = []byte{0x91, 0x07, 0xDC, 0xB7, 0xB7, 0xA9, 0xCF, 0x11, 0x8E, 0xE6, 0x00, 0xC0, 0x0C, 0x20, 0x53, 0x65}
+	asfAudioMediaGUID       = []byte{0x40, 0x9E, 0x69, 0xF8, 0x4D, 0x5B, 0xCF, 0x11, 0xA8, 0xFD, 0x00, 0x80, 0x5F, 0x5C, 0x44, 0x2B}
+)
+
+// Detect identifies the audio format of r from its content, ignoring the
+// file name. Anything that is not audio, including video containers,
+// yields ErrUnsupported.
+func Detect(r io.ReaderAt, size int64) (Format, error) {
+	head := make([]byte, 16)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return FormatFLAC, nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return detectOgg(r, size)
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return detectMP4(r, size)
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return FormatWAV, nil
+	case bytes.HasPrefix(head, asfHeaderGUID):
+		return detectASF(r, size)
+	case bytes.HasPrefix(head, []byte("ID3")):
+		// FLAC files are occasionally prefixed with an ID3v2 tag
+		end, err := id3v2End(r)
+		if err != nil {
+			return "", err
+		}
+		magic := make([]byte, 4)
+		if _, err := r.ReadAt(magic, end); err == nil && string(magic) == "fLaC" {
+			return FormatFLAC, nil
+		}
+		return detectMPEG(r, end, size)
+	}
+	return detectMPEG(r, 0, size)
+}
+
+// detectMPEG looks for two consecutive MPEG audio or ADTS frames near start.
+func detectMPEG(r io.ReaderAt, start, size int64) (Format, error) {
+	window := min(int64(mp3SyncSearch), size-start)
+	if window < 4 {
+		return "", ErrUnsupported
+	}
+	buf := make([]byte, window)
+	n, _ := r.ReadAt(buf, start)
+	buf = buf[:n]
+
+	for i := 0; i+7 <= len(buf); i++ {
+		if length, ok := adtsFrameLength(buf[i:]); ok {
+			if next := i + length; next+7 > len(buf) || isADTS(buf[next:]) {
+				return FormatAAC, nil
+			}
+		}
+		if frame, ok := parseMP3Frame(buf[i:]); ok {
+			if next := i + frame.length; next+4 > len(buf) {
+				return FormatMP3, nil
+			} else if _, ok := parseMP3Frame(buf[next:]); ok {
+				return FormatMP3, nil
+			}
+		}
+		if start == 0 {
+			break // Without a tag the stream has to start right away
+		}
+	}
+	return "", ErrUnsupported
+}
+
+func isADTS(h []byte) bool {
+	_, ok := adtsFrameLength(h)
+	return ok
+}
+
+// adtsFrameLength parses an ADTS header: sync word with layer 0, a valid
+// sampling frequency index and a frame length covering the header.
+func adtsFrameLength(h []byte) (int, bool) {
+	if len(h) < 7 || h[0] != 0xFF || h[1]&0xF6 != 0xF0 || (h[2]>>2)&0x0F > 12 {
+		return 0, false
+	}
+	length := int(h[3]&0x03)<<11 | int(h[4])<<3 | int(h[5])>>5
+	if length < 7 {
+		return 0, false
+	}
+	return length, true
+}
+
+// detectOgg tells Vorbis and Opus apart by the identification header of the
+// first logical stream.
+func detectOgg(r io.ReaderAt, size int64) (Format, error) {
+	packets, _, err := oggPackets(r, size, 1)
+	if err != nil {
+		return "", ErrUnsupported
+	}
+	switch ident := packets[0]; {
+	case bytes.HasPrefix(ident, []byte("\x01vorbis")):
+		return FormatVorbis, nil
+	case bytes.HasPrefix(ident, []byte("OpusHead")):
+		return FormatOpus, nil
+	}
+	return "", ErrUnsupported
+}
+
+// detectMP4 accepts MP4 files whose tracks are all sound tracks.
+func detectMP4(r io.ReaderAt, size int64) (Format, error) {
+	moov, ok := findMP4Box(r, 0, size, "moov")
+	if !ok {
+		return "", ErrUnsupported
+	}
+	boxes, err := mp4Boxes(r, moov.dataOffset, moov.end)
+	if err != nil {
+		return "", ErrUnsupported
+	}
+	sound := false
+	for _, trak := range boxes {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr, ok := findMP4Box(r, trak.dataOffset, trak.end, "mdia", "hdlr")
+		if !ok {
+			continue
+		}
+		handler, err := readAt(r, hdlr.dataOffset+8, 4)
+		if err != nil {
+			return "", ErrUnsupported
+		}
+		switch string(handler) {
+		case "soun":
+			sound = true
+		case "vide":
+			return "", ErrUnsupported
+		}
+	}
+	if !sound {
+		return "", ErrUnsupported
+	}
+	return FormatM4A, nil
+}
+
+// detectASF accepts ASF files that carry audio streams only.
+func detectASF(r io.ReaderAt, size int64) (Format, error) {
+	header, err := readAt(r, 0, 30)
+	if err != nil {
+		return "", ErrUnsupported
+	}
+	end := min(int64(binary.LittleEndian.Uint64(header[16:24])), size)
+
+	sound := false
+	for pos := int64(30); pos+40 <= end; {
+		object, err := readAt(r, pos, 40)
+		if err != nil {
+			return "", ErrUnsupported
+		}
+		objectSize := int64(binary.LittleEndian.Uint64(object[16:24]))
+		if objectSize < 24 {
+			return "", ErrUnsupported
+		}
+		if bytes.Equal(object[:16], asfStreamPropertiesGUID) {
+			if !bytes.Equal(object[24:40], asfAudioMediaGUID) {
+				return "", ErrUnsupported
+			}
+			sound = true
+		}
+		pos += objectSize
+	}
+	if !sound {
+		return "", ErrUnsupported
+	}
+	return FormatWMA, nil
+}
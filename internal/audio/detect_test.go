@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// adtsFrames returns n ADTS frames of length bytes each.
+func adtsFrames(n, length int) []byte {
+	frame := make([]byte, length)
+	copy(frame, []byte{0xFF, 0xF1, 0x50, 0x80 | byte(length>>11), byte(length >> 3), byte(length<<5) | 0x1F, 0xFC})
+	return bytes.Repeat(frame, n)
+}
+
+// asfFile builds an ASF header with one stream properties object per stream
+// type GUID.
+func asfFile(streamTypes ...[]byte) []byte {
+	var objects []byte
+	for _, typ := range streamTypes {
+		objects = concat(objects, asfStreamPropertiesGUID, binary.LittleEndian.AppendUint64(nil, 40+16), typ, make([]byte, 16))
+	}
+	size := 30 + len(objects)
+	return concat(asfHeaderGUID, binary.LittleEndian.AppendUint64(nil, uint64(size)), make([]byte, 6), objects)
+}
+
+func TestDetect(t *testing.T) {
+	flac := concat([]byte("fLaC"), flacBlock(flacStreamInfo, true, flacStreamInfoBlock(44100, 0)))
+	vorbisIdent := concat([]byte("\x01vorbis"), le32(0), []byte{2}, le32(44100), make([]byte, 14))
+	asfVideo := []byte{0xC0, 0xEF, 0x19, 0xBC, 0x4D, 0x5B, 0xCF, 0x11, 0xA8, 0xFD, 0x00, 0x80, 0x5F, 0x5C, 0x44, 0x2B}
+
+	tests := []struct {
+		name string
+		file []byte
+		want Format
+	}{
+		{"mp3", mp3Frames(2, 0), FormatMP3},
+		{"mp3 after ID3", concat(id3v23(id3v23Frame("TIT2", []byte("\x00x"))), make([]byte, 10), mp3Frames(2, 0)), FormatMP3},
+		{"aac", adtsFrames(3, 100), FormatAAC},
+		{"flac", flac, FormatFLAC},
+		{"flac after ID3", concat(id3v23(id3v23Frame("TIT2", []byte("\x00x"))), flac), FormatFLAC},
+		{"vorbis", oggPageBytes(1, 0, vorbisIdent), FormatVorbis},
+		{"opus", oggPageBytes(1, 0, []byte("OpusHead\x01\x02\x00\x00")), FormatOpus},
+		{"m4a", mp4File(1, []string{"soun"}), FormatM4A},
+		{"wav", wavFile(8000, 100), FormatWAV},
+		{"wma", asfFile(asfAudioMediaGUID), FormatWMA},
+
+		{"empty", nil, ""},
+		{"text", []byte("just some text, not audio at all"), ""},
+		{"mp3 frame after junk", concat([]byte("junk"), mp3Frames(2, 0)), ""},
+		{"ogg theora", oggPageBytes(1, 0, []byte("\x80theora")), ""},
+		{"mp4 video", mp4File(1, []string{"soun", "vide"}), ""},
+		{"mp4 without tracks", mp4File(1, nil), ""},
+		{"asf video", asfFile(asfAudioMediaGUID, asfVideo), ""},
+	}
+	for _, tt := range tests {
+		got, err := Detect(bytes.NewReader(tt.file), int64(len(tt.file)))
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("%s: Detect = %q, %v, want ErrUnsupported", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Detect = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
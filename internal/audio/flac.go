@@ -0,0 +1,67 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// readFLAC walks the metadata blocks of a native FLAC stream starting at off.
+func readFLAC(r io.ReaderAt, size int64, off int64) (*Tags, error) {
+	tags := &Tags{}
+	pos := off + 4 // "fLaC"
+
+	for pos < size {
+		header, err := readAt(r, pos, 4)
+		if err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		pos += 4
+
+		switch blockType {
+		case flacStreamInfo:
+			info, err := readAt(r, pos, length)
+			if err != nil {
+				return nil, err
+			}
+			if len(info) < 18 {
+				return nil, errors.New("short FLAC STREAMINFO block")
+			}
+			rate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+			samples := int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:18]))
+			tags.Duration = durationFromSamples(samples, rate)
+		case flacVorbisComment:
+			block, err := readAt(r, pos, length)
+			if err != nil {
+				return nil, err
+			}
+			if err := parseVorbisComment(block, tags); err != nil {
+				return nil, err
+			}
+		case flacPicture:
+			block, err := readAt(r, pos, length)
+			if err != nil {
+				return nil, err
+			}
+			if p, err := parseFLACPicture(block); err == nil {
+				tags.addPicture(p)
+			}
+		}
+
+		pos += int64(length)
+		if last {
+			break
+		}
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,219 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const id3v1Size = 128
+
+// id3Frame is a single decoded ID3v2 frame.
+type id3Frame struct {
+	id   string
+	data []byte
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// id3v2End returns the offset of the first byte after the ID3v2 tag at the
+// start of r, or 0 if there is none.
+func id3v2End(r io.ReaderAt) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "ID3" {
+		return 0, nil
+	}
+	end := int64(10 + syncsafe(header[6:10]))
+	if header[5]&0x10 != 0 { // footer present
+		end += 10
+	}
+	return end, nil
+}
+
+// removeUnsync reverses ID3v2 unsynchronisation (0xFF 0x00 -> 0xFF).
+func removeUnsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// readID3v2 returns the frames of the ID3v2 tag at the start of r.
+func readID3v2(r io.ReaderAt) ([]id3Frame, error) {
+	header, err := readAt(r, 0, 10)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "ID3" {
+		return nil, nil
+	}
+	version := header[3]
+	flags := header[5]
+	body, err := readAt(r, 10, syncsafe(header[6:10]))
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 { // extended header
+		var extSize int
+		if version == 4 {
+			extSize = syncsafe(body[:4])
+		} else {
+			extSize = int(binary.BigEndian.Uint32(body[:4])) + 4
+		}
+		if extSize > len(body) {
+			return nil, errors.New("invalid ID3v2 extended header")
+		}
+		body = body[extSize:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	var frames []id3Frame
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var size int
+		var formatFlags byte
+		switch version {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+			formatFlags = body[9]
+		default:
+			size = syncsafe(body[4:8])
+			formatFlags = body[9]
+		}
+		if size > len(body)-headerLen {
+			break
+		}
+		data := body[headerLen : headerLen+size]
+		body = body[headerLen+size:]
+
+		switch version {
+		case 3:
+			if formatFlags&0xC0 != 0 { // compressed or encrypted
+				continue
+			}
+			if formatFlags&0x20 != 0 && len(data) > 0 { // grouping identity
+				data = data[1:]
+			}
+		case 4:
+			if formatFlags&0x0C != 0 { // compressed or encrypted
+				continue
+			}
+			if formatFlags&0x40 != 0 && len(data) > 0 { // grouping identity
+				data = data[1:]
+			}
+			if formatFlags&0x01 != 0 && len(data) >= 4 { // data length indicator
+				data = data[4:]
+			}
+			if formatFlags&0x02 != 0 || flags&0x80 != 0 {
+				data = removeUnsync(data)
+			}
+		}
+
+		frames = append(frames, id3Frame{id: id, data: data})
+	}
+
+	return frames, nil
+}
+
+// applyID3v2 copies the frames we understand into tags.
+func applyID3v2(frames []id3Frame, tags *Tags) {
+	for _, f := range frames {
+		switch f.id {
+		case "TIT2", "TT2":
+			setIfEmpty(&tags.Title, decodeID3Text(f.data))
+		case "TPE1", "TP1":
+			setIfEmpty(&tags.Artist, decodeID3Text(f.data))
+		case "TALB", "TAL":
+			setIfEmpty(&tags.Album, decodeID3Text(f.data))
+		case "APIC":
+			tags.addPicture(parseAPIC(f.data, false))
+		case "PIC":
+			tags.addPicture(parseAPIC(f.data, true))
+		}
+	}
+}
+
+// decodeID3Text decodes a text frame body (encoding byte followed by text)
+// and returns its first value.
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	text := decodeID3String(b[0], b[1:])
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return text
+}
+
+func decodeID3String(encoding byte, b []byte) string {
+	switch encoding {
+	case 0: // ISO-8859-1
+		return latin1(b)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(b) >= 2 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				bigEndian, b = false, b[2:]
+			} else if b[0] == 0xFE && b[1] == 0xFF {
+				bigEndian, b = true, b[2:]
+			}
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		return string(utf16.Decode(units))
+	default: // UTF-8
+		return string(b)
+	}
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// readID3v1 fills empty fields from an ID3v1 tag at the end of the file and
+// reports whether one was present.
+func readID3v1(r io.ReaderAt, size int64, tags *Tags) bool {
+	if size < id3v1Size {
+		return false
+	}
+	tag, err := readAt(r, size-id3v1Size, id3v1Size)
+	if err != nil || string(tag[:3]) != "TAG" {
+		return false
+	}
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return latin1(b)
+	}
+	setIfEmpty(&tags.Title, field(tag[3:33]))
+	setIfEmpty(&tags.Artist, field(tag[33:63]))
+	setIfEmpty(&tags.Album, field(tag[63:93]))
+	return true
+}
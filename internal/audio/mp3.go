@@ -0,0 +1,167 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// How far past the ID3v2 tag we look for the first MPEG frame.
+const mp3SyncSearch = 64 << 10
+
+var (
+	mp3BitratesV1 = [3][15]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // Layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // Layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // Layer III
+	}
+	mp3BitratesV2 = [3][15]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}, // Layer I
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // Layer II
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // Layer III
+	}
+	mp3SampleRates = map[byte][3]int{
+		3: {44100, 48000, 32000}, // MPEG 1
+		2: {22050, 24000, 16000}, // MPEG 2
+		0: {11025, 12000, 8000},  // MPEG 2.5
+	}
+)
+
+// mp3Frame is a parsed MPEG audio frame header.
+type mp3Frame struct {
+	version    byte // 3 = MPEG 1, 2 = MPEG 2, 0 = MPEG 2.5
+	layer      int  // 1, 2 or 3
+	bitrate    int  // kbit/s
+	sampleRate int
+	mono       bool
+	length     int // Frame length in bytes
+	samples    int // Samples per frame
+}
+
+func isMPEGSync(b0, b1 byte) bool {
+	return b0 == 0xFF && b1&0xE0 == 0xE0
+}
+
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	if len(h) < 4 || !isMPEGSync(h[0], h[1]) {
+		return mp3Frame{}, false
+	}
+	f := mp3Frame{version: (h[1] >> 3) & 3}
+	layerBits := (h[1] >> 1) & 3
+	bitrateIndex := h[2] >> 4
+	rateIndex := (h[2] >> 2) & 3
+	if f.version == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	f.layer = 4 - int(layerBits)
+	padding := int(h[2]>>1) & 1
+	f.mono = h[3]>>6 == 3
+
+	if f.version == 3 {
+		f.bitrate = mp3BitratesV1[f.layer-1][bitrateIndex]
+	} else {
+		f.bitrate = mp3BitratesV2[f.layer-1][bitrateIndex]
+	}
+	f.sampleRate = mp3SampleRates[f.version][rateIndex]
+
+	switch {
+	case f.layer == 1:
+		f.samples = 384
+		f.length = (12*f.bitrate*1000/f.sampleRate + padding) * 4
+	case f.layer == 3 && f.version != 3:
+		f.samples = 576
+		f.length = 72*f.bitrate*1000/f.sampleRate + padding
+	default:
+		f.samples = 1152
+		f.length = 144*f.bitrate*1000/f.sampleRate + padding
+	}
+	return f, true
+}
+
+// readMP3 reads ID3 tags and computes the duration from the MPEG stream.
+func readMP3(r io.ReaderAt, size int64) (*Tags, error) {
+	tags := &Tags{}
+
+	frames, err := readID3v2(r)
+	if err != nil {
+		return nil, err
+	}
+	applyID3v2(frames, tags)
+
+	audioEnd := size
+	if readID3v1(r, size, tags) {
+		audioEnd -= id3v1Size
+	}
+
+	start, err := id3v2End(r)
+	if err != nil {
+		return nil, err
+	}
+	tags.Duration = mp3Duration(r, start, audioEnd)
+
+	return tags, nil
+}
+
+// mp3Duration finds the first frame after start and derives the duration
+// from a Xing/Info or VBRI header, falling back to a constant bitrate estimate.
+func mp3Duration(r io.ReaderAt, start, end int64) time.Duration {
+	window := int64(mp3SyncSearch)
+	if end-start < window {
+		window = end - start
+	}
+	if window < 4 {
+		return 0
+	}
+	buf := make([]byte, window)
+	n, _ := r.ReadAt(buf, start)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		frame, ok := parseMP3Frame(buf[i:])
+		if !ok {
+			continue
+		}
+		// Require the next frame to line up, to skip false syncs
+		if next := i + frame.length; next+4 <= len(buf) {
+			if _, ok := parseMP3Frame(buf[next:]); !ok {
+				continue
+			}
+		}
+
+		frameStart := start + int64(i)
+		if count := mp3FrameCount(r, frameStart, frame); count > 0 {
+			return durationFromSamples(count*int64(frame.samples), int64(frame.sampleRate))
+		}
+		bytes := end - frameStart
+		return time.Duration(float64(bytes*8) / float64(frame.bitrate*1000) * float64(time.Second))
+	}
+	return 0
+}
+
+// mp3FrameCount reads the total frame count from a Xing/Info or VBRI header in
+// the first frame, or returns 0 if there is none.
+func mp3FrameCount(r io.ReaderAt, frameStart int64, frame mp3Frame) int64 {
+	b := make([]byte, 64)
+	n, _ := r.ReadAt(b, frameStart)
+	b = b[:n]
+
+	sideInfo := 32
+	switch {
+	case frame.version == 3 && frame.mono:
+		sideInfo = 17
+	case frame.version != 3 && frame.mono:
+		sideInfo = 9
+	case frame.version != 3:
+		sideInfo = 17
+	}
+	if x := 4 + sideInfo; len(b) >= x+12 {
+		tag := string(b[x : x+4])
+		if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(b[x+4:])&1 != 0 {
+			return int64(binary.BigEndian.Uint32(b[x+8:]))
+		}
+	}
+	if len(b) >= 36+18 && string(b[36:40]) == "VBRI" {
+		return int64(binary.BigEndian.Uint32(b[36+14:]))
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// mp4Box is an ISO base media box header.
+type mp4Box struct {
+	typ        string
+	dataOffset int64 // First byte after the header
+	end        int64
+}
+
+// mp4Boxes lists the boxes between start and end.
+func mp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for pos := start; pos+8 <= end; {
+		header, err := readAt(r, pos, 8)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		box := mp4Box{typ: string(header[4:8]), dataOffset: pos + 8}
+		switch size {
+		case 0: // Extends to the end
+			size = end - pos
+		case 1: // 64-bit size follows
+			large, err := readAt(r, pos+8, 8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(large))
+			box.dataOffset += 8
+		}
+		if size < box.dataOffset-pos || pos+size > end {
+			return nil, errors.New("invalid MP4 box size")
+		}
+		box.end = pos + size
+		boxes = append(boxes, box)
+		pos += size
+	}
+	return boxes, nil
+}
+
+// findMP4Box descends through the boxes named in path.
+func findMP4Box(r io.ReaderAt, start, end int64, path ...string) (mp4Box, bool) {
+	var found mp4Box
+	for _, name := range path {
+		boxes, err := mp4Boxes(r, start, end)
+		if err != nil {
+			return mp4Box{}, false
+		}
+		ok := false
+		for _, b := range boxes {
+			if b.typ == name {
+				found, ok = b, true
+				break
+			}
+		}
+		if !ok {
+			return mp4Box{}, false
+		}
+		start, end = found.dataOffset, found.end
+		if name == "meta" {
+			start = metaChildrenOffset(r, found)
+		}
+	}
+	return found, true
+}
+
+// metaChildrenOffset skips the version/flags of a "meta" full box. QuickTime
+// files omit them, which shows as a child box starting right away.
+func metaChildrenOffset(r io.ReaderAt, meta mp4Box) int64 {
+	if b, err := readAt(r, meta.dataOffset, 8); err == nil && string(b[4:8]) == "hdlr" {
+		return meta.dataOffset
+	}
+	return meta.dataOffset + 4
+}
+
+// mp4ItemData returns the payload of the "data" box of an ilst item.
+func mp4ItemData(r io.ReaderAt, item mp4Box) ([]byte, bool) {
+	data, ok := findMP4Box(r, item.dataOffset, item.end, "data")
+	if !ok || data.end-data.dataOffset < 8 {
+		return nil, false
+	}
+	b, err := readAt(r, data.dataOffset+8, int(data.end-data.dataOffset-8))
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// readMP4 reads iTunes-style metadata and the movie duration.
+func readMP4(r io.ReaderAt, size int64) (*Tags, error) {
+	moov, ok := findMP4Box(r, 0, size, "moov")
+	if !ok {
+		return nil, errors.New("MP4 file has no moov box")
+	}
+	tags := &Tags{}
+
+	if mvhd, ok := findMP4Box(r, moov.dataOffset, moov.end, "mvhd"); ok {
+		b, err := readAt(r, mvhd.dataOffset, int(min(mvhd.end-mvhd.dataOffset, 32)))
+		if err == nil && len(b) >= 20 {
+			if b[0] == 1 && len(b) >= 32 {
+				timescale := int64(binary.BigEndian.Uint32(b[20:24]))
+				duration := int64(binary.BigEndian.Uint64(b[24:32]))
+				tags.Duration = durationFromSamples(duration, timescale)
+			} else {
+				timescale := int64(binary.BigEndian.Uint32(b[12:16]))
+				duration := int64(binary.BigEndian.Uint32(b[16:20]))
+				tags.Duration = durationFromSamples(duration, timescale)
+			}
+		}
+	}
+
+	ilst, ok := findMP4Box(r, moov.dataOffset, moov.end, "udta", "meta", "ilst")
+	if !ok {
+		return tags, nil
+	}
+	items, err := mp4Boxes(r, ilst.dataOffset, ilst.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var field *string
+		switch item.typ {
+		case "covr":
+			tags.addPicture(mp4Cover(r, item))
+			continue
+		case "\xa9nam":
+			field = &tags.Title
+		case "\xa9ART", "aART":
+			field = &tags.Artist
+		case "\xa9alb":
+			field = &tags.Album
+		default:
+			continue
+		}
+		if value, ok := mp4ItemData(r, item); ok {
+			setIfEmpty(field, string(value))
+		}
+	}
+
+	return tags, nil
+}
+
+// mp4Cover decodes a "covr" item; the data type tells JPEG and PNG apart.
+func mp4Cover(r io.ReaderAt, item mp4Box) *Picture {
+	data, ok := findMP4Box(r, item.dataOffset, item.end, "data")
+	if !ok || data.end-data.dataOffset < 8 {
+		return nil
+	}
+	b, err := readAt(r, data.dataOffset, int(data.end-data.dataOffset))
+	if err != nil {
+		return nil
+	}
+	p := &Picture{Type: PictureFrontCover, MIMEType: "image/jpeg", Data: b[8:]}
+	if binary.BigEndian.Uint32(b[:4])&0xFFFFFF == 14 {
+		p.MIMEType = "image/png"
+	}
+	return p
+}
@@ -0,0 +1,152 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	oggPageHeader = 27
+	// How far from the end we look for the last page.
+	oggTailSearch = 64 << 10
+	opusRate      = 48000
+)
+
+// oggPage is the header of a single Ogg page.
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte
+}
+
+func parseOggPage(b []byte) (oggPage, int, bool) {
+	if len(b) < oggPageHeader || string(b[:4]) != "OggS" {
+		return oggPage{}, 0, false
+	}
+	n := int(b[26])
+	if len(b) < oggPageHeader+n {
+		return oggPage{}, 0, false
+	}
+	return oggPage{
+		granule:  int64(binary.LittleEndian.Uint64(b[6:14])),
+		serial:   binary.LittleEndian.Uint32(b[14:18]),
+		segments: b[oggPageHeader : oggPageHeader+n],
+	}, oggPageHeader + n, true
+}
+
+// oggPackets returns the first count packets of the first logical stream.
+func oggPackets(r io.ReaderAt, size int64, count int) ([][]byte, uint32, error) {
+	var packets [][]byte
+	var current []byte
+	var serial uint32
+	pos := int64(0)
+
+	for pos < size && len(packets) < count {
+		header, err := readAt(r, pos, oggPageHeader)
+		if err != nil {
+			return nil, 0, err
+		}
+		if string(header[:4]) != "OggS" {
+			return nil, 0, errors.New("lost Ogg page sync")
+		}
+		segCount := int(header[26])
+		full, err := readAt(r, pos, oggPageHeader+segCount)
+		if err != nil {
+			return nil, 0, err
+		}
+		page, headerLen, _ := parseOggPage(full)
+		if pos == 0 {
+			serial = page.serial
+		}
+
+		dataLen := 0
+		for _, s := range page.segments {
+			dataLen += int(s)
+		}
+		if page.serial == serial {
+			data, err := readAt(r, pos+int64(headerLen), dataLen)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, s := range page.segments {
+				current = append(current, data[:s]...)
+				data = data[s:]
+				if len(current) > maxTagSize {
+					return nil, 0, errors.New("Ogg packet too large")
+				}
+				if s < 255 {
+					packets = append(packets, current)
+					current = nil
+					if len(packets) == count {
+						break
+					}
+				}
+			}
+		}
+		pos += int64(headerLen + dataLen)
+	}
+
+	if len(packets) < count {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return packets, serial, nil
+}
+
+// lastGranule returns the granule position of the last page of the stream.
+func lastGranule(r io.ReaderAt, size int64, serial uint32) int64 {
+	window := int64(oggTailSearch)
+	if size < window {
+		window = size
+	}
+	buf := make([]byte, window)
+	n, _ := r.ReadAt(buf, size-window)
+	buf = buf[:n]
+
+	for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+		page, _, ok := parseOggPage(buf[i:])
+		if ok && page.serial == serial && page.granule >= 0 {
+			return page.granule
+		}
+	}
+	return -1
+}
+
+// readOgg handles Ogg Vorbis and Ogg Opus.
+func readOgg(r io.ReaderAt, size int64) (*Tags, error) {
+	packets, serial, err := oggPackets(r, size, 2)
+	if err != nil {
+		return nil, err
+	}
+	ident, comment := packets[0], packets[1]
+	tags := &Tags{}
+
+	var rate, preSkip int64
+	switch {
+	case len(ident) >= 16 && bytes.HasPrefix(ident, []byte("\x01vorbis")):
+		rate = int64(binary.LittleEndian.Uint32(ident[12:16]))
+		if !bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			return nil, errors.New("missing Vorbis comment header")
+		}
+		comment = comment[7:]
+	case len(ident) >= 12 && bytes.HasPrefix(ident, []byte("OpusHead")):
+		rate = opusRate
+		preSkip = int64(binary.LittleEndian.Uint16(ident[10:12]))
+		if !bytes.HasPrefix(comment, []byte("OpusTags")) {
+			return nil, errors.New("missing OpusTags header")
+		}
+		comment = comment[8:]
+	default:
+		return nil, ErrUnsupported
+	}
+
+	if err := parseVorbisComment(comment, tags); err != nil {
+		return nil, err
+	}
+	if granule := lastGranule(r, size, serial); granule > preSkip {
+		tags.Duration = durationFromSamples(granule-preSkip, rate)
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,140 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// Picture types from the ID3v2 APIC / FLAC PICTURE specification.
+const (
+	PictureOther      = 0
+	PictureFrontCover = 3
+)
+
+// Picture is an embedded image such as album art.
+type Picture struct {
+	MIMEType string
+	Type     byte
+	Data     []byte
+}
+
+// addPicture keeps the front cover if there is one, otherwise the first
+// picture found.
+func (t *Tags) addPicture(p *Picture) {
+	if p == nil || len(p.Data) == 0 {
+		return
+	}
+	if t.Picture == nil || (t.Picture.Type != PictureFrontCover && p.Type == PictureFrontCover) {
+		t.Picture = p
+	}
+}
+
+// parseAPIC decodes an ID3v2.3/2.4 APIC frame, or a v2.2 PIC frame when
+// legacy is set.
+func parseAPIC(b []byte, legacy bool) *Picture {
+	if len(b) < 2 {
+		return nil
+	}
+	encoding := b[0]
+	b = b[1:]
+
+	p := &Picture{}
+	if legacy {
+		if len(b) < 4 {
+			return nil
+		}
+		switch string(bytes.ToUpper(b[:3])) {
+		case "PNG":
+			p.MIMEType = "image/png"
+		default:
+			p.MIMEType = "image/jpeg"
+		}
+		b = b[3:]
+	} else {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return nil
+		}
+		p.MIMEType = string(b[:i])
+		b = b[i+1:]
+	}
+	if len(b) < 1 {
+		return nil
+	}
+	p.Type = b[0]
+	b = b[1:]
+
+	// Skip the description, terminated by one or two zero bytes depending on
+	// the text encoding
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				p.Data = b[i+2:]
+				break
+			}
+		}
+	} else if i := bytes.IndexByte(b, 0); i >= 0 {
+		p.Data = b[i+1:]
+	}
+	if p.Data == nil {
+		return nil
+	}
+	return p
+}
+
+var errShortPicture = errors.New("truncated picture block")
+
+// parseFLACPicture decodes a FLAC PICTURE metadata block, which Ogg streams
+// also carry base64 encoded in METADATA_BLOCK_PICTURE comments.
+func parseFLACPicture(b []byte) (*Picture, error) {
+	next := func() ([]byte, error) {
+		if len(b) < 4 {
+			return nil, errShortPicture
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(n) > uint64(len(b)) {
+			return nil, errShortPicture
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+
+	if len(b) < 4 {
+		return nil, errShortPicture
+	}
+	p := &Picture{Type: byte(binary.BigEndian.Uint32(b))}
+	b = b[4:]
+
+	mime, err := next()
+	if err != nil {
+		return nil, err
+	}
+	p.MIMEType = string(mime)
+	if _, err := next(); err != nil { // description
+		return nil, err
+	}
+	if len(b) < 16 {
+		return nil, errShortPicture
+	}
+	b = b[16:] // width, height, depth, colors
+	if p.Data, err = next(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseBase64Picture(value string) *Picture {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	p, err := parseFLACPicture(raw)
+	if err != nil {
+		return nil
+	}
+	return p
+}
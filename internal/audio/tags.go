@@ -0,0 +1,85 @@
+// Package audio reads tags and stream properties from audio files without
+// decoding them.
+package audio
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned for files that are not recognised as audio.
+var ErrUnsupported = errors.New("unsupported audio format")
+
+// maxTagSize bounds how much of a file is read into memory for a single tag
+// block, so a corrupt length field cannot exhaust memory.
+const maxTagSize = 32 << 20
+
+// Tags holds the metadata found in a file.
+type Tags struct {
+	Title    string
+	Artist   string
+	Album    string
+	Duration time.Duration
+	Picture  *Picture // Embedded cover art, nil if there is none
+}
+
+// ReadTags parses the tags and duration of the audio file in r, which is
+// size bytes long.
+func ReadTags(r io.ReaderAt, size int64) (*Tags, error) {
+	format, err := Detect(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatFLAC:
+		// Skips an ID3v2 tag some taggers put in front
+		start, err := id3v2End(r)
+		if err != nil {
+			return nil, err
+		}
+		return readFLAC(r, size, start)
+	case FormatVorbis, FormatOpus:
+		return readOgg(r, size)
+	case FormatM4A:
+		return readMP4(r, size)
+	case FormatWAV:
+		return readWAV(r, size)
+	case FormatMP3:
+		return readMP3(r, size)
+	}
+	return nil, ErrUnsupported
+}
+
+// readAt reads exactly n bytes at off.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	if n < 0 || n > maxTagSize {
+		return nil, errors.New("block too large")
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// setIfEmpty assigns value to *field unless the field is already set.
+func setIfEmpty(field *string, value string) {
+	value = strings.TrimSpace(value)
+	if *field == "" && value != "" {
+		*field = value
+	}
+}
+
+// durationFromSamples converts a sample count at rate Hz to a duration.
+func durationFromSamples(samples, rate int64) time.Duration {
+	if rate <= 0 || samples <= 0 {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+}
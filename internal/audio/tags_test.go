@@ -0,0 +1,294 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// The files below are built in memory with just enough structure for the
+// parsers: headers and tags are real, audio payloads are zero bytes.
+
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func id3Syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// id3v23 builds an ID3v2.3 tag from frame IDs and bodies.
+func id3v23(frames ...[]byte) []byte {
+	body := concat(frames...)
+	return concat([]byte("ID3\x03\x00\x00"), id3Syncsafe(len(body)), body)
+}
+
+func id3v23Frame(id string, data []byte) []byte {
+	return concat([]byte(id), be32(uint32(len(data))), []byte{0, 0}, data)
+}
+
+func utf16Text(s string) []byte {
+	b := []byte{1, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// mp3Frames returns n MPEG-1 Layer III frames at 128 kbit/s and 44.1 kHz,
+// 417 bytes each. With xingFrames set the first one carries a Xing header
+// with that frame count.
+func mp3Frames(n int, xingFrames uint32) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	var b []byte
+	for i := 0; i < n; i++ {
+		f := bytes.Clone(frame)
+		if i == 0 && xingFrames > 0 {
+			copy(f[36:], concat([]byte("Xing"), be32(1), be32(xingFrames)))
+		}
+		b = append(b, f...)
+	}
+	return b
+}
+
+func id3v1(title, artist, album string) []byte {
+	tag := make([]byte, id3v1Size)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	return tag
+}
+
+func vorbisComment(fields ...string) []byte {
+	b := concat(le32(6), []byte("vendor"), le32(uint32(len(fields))))
+	for _, f := range fields {
+		b = concat(b, le32(uint32(len(f))), []byte(f))
+	}
+	return b
+}
+
+func flacPictureBlock(pictureType uint32, mime string, data []byte) []byte {
+	return concat(be32(pictureType), be32(uint32(len(mime))), []byte(mime),
+		be32(0), make([]byte, 16), be32(uint32(len(data))), data)
+}
+
+func flacBlock(blockType byte, last bool, data []byte) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	n := len(data)
+	return concat([]byte{blockType, byte(n >> 16), byte(n >> 8), byte(n)}, data)
+}
+
+// flacStreamInfoBlock describes samples samples at rate Hz, stereo 16 bit.
+func flacStreamInfoBlock(rate int, samples int64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(rate >> 12)
+	info[11] = byte(rate >> 4)
+	info[12] = byte(rate<<4) | 1<<1 // two channels
+	info[13] = 15<<4 | byte(samples>>32)&0x0F
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+	return info
+}
+
+// oggPageBytes builds an Ogg page holding packets; the CRC is not checked.
+func oggPageBytes(serial uint32, granule int64, packets ...[]byte) []byte {
+	var lacing, data []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		data = append(data, p...)
+	}
+	header := concat([]byte("OggS\x00\x00"), binary.LittleEndian.AppendUint64(nil, uint64(granule)),
+		le32(serial), le32(0), le32(0), []byte{byte(len(lacing))})
+	return concat(header, lacing, data)
+}
+
+func mp4BoxBytes(typ string, payload ...[]byte) []byte {
+	body := concat(payload...)
+	return concat(be32(uint32(8+len(body))), []byte(typ), body)
+}
+
+func mp4Item(typ string, dataType uint32, value []byte) []byte {
+	return mp4BoxBytes(typ, mp4BoxBytes("data", be32(dataType), be32(0), value))
+}
+
+func mp4Track(handler string) []byte {
+	return mp4BoxBytes("trak", mp4BoxBytes("mdia", mp4BoxBytes("hdlr", be32(0), be32(0), []byte(handler), make([]byte, 12))))
+}
+
+// mp4File builds an MP4 file with the given tracks lasting seconds, and
+// iTunes metadata when ilst items are given.
+func mp4File(seconds uint32, tracks []string, items ...[]byte) []byte {
+	mvhd := mp4BoxBytes("mvhd", be32(0), be32(0), be32(0), be32(1000), be32(seconds*1000), make([]byte, 80))
+	moov := [][]byte{mvhd}
+	for _, h := range tracks {
+		moov = append(moov, mp4Track(h))
+	}
+	if len(items) > 0 {
+		meta := mp4BoxBytes("meta", be32(0), mp4BoxBytes("hdlr", be32(0), be32(0), []byte("mdir"), make([]byte, 12)),
+			mp4BoxBytes("ilst", items...))
+		moov = append(moov, mp4BoxBytes("udta", meta))
+	}
+	return concat(mp4BoxBytes("ftyp", []byte("M4A "), be32(0)), mp4BoxBytes("moov", moov...), mp4BoxBytes("mdat", make([]byte, 64)))
+}
+
+func riffChunk(id string, data []byte) []byte {
+	b := concat([]byte(id), le32(uint32(len(data))), data)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wavFile builds a PCM WAV file with byteRate bytes per second of audio and
+// dataSize bytes of it, followed by the given chunks.
+func wavFile(byteRate uint32, dataSize int, chunks ...[]byte) []byte {
+	format := concat([]byte{1, 0, 2, 0}, le32(byteRate/4), le32(byteRate), []byte{4, 0, 16, 0})
+	body := concat([]byte("WAVE"), riffChunk("fmt ", format), riffChunk("data", make([]byte, dataSize)), concat(chunks...))
+	return concat([]byte("RIFF"), le32(uint32(len(body))), body)
+}
+
+func readTags(t *testing.T, b []byte) *Tags {
+	t.Helper()
+	tags, err := ReadTags(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("ReadTags: %v", err)
+	}
+	return tags
+}
+
+func checkTags(t *testing.T, got *Tags, title, artist, album string, duration time.Duration) {
+	t.Helper()
+	if got.Title != title || got.Artist != artist || got.Album != album {
+		t.Errorf("tags = %q / %q / %q, want %q / %q / %q", got.Title, got.Artist, got.Album, title, artist, album)
+	}
+	if d := got.Duration - duration; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("duration = %v, want %v", got.Duration, duration)
+	}
+}
+
+func checkPicture(t *testing.T, got *Tags, mime string, data []byte) {
+	t.Helper()
+	if got.Picture == nil {
+		t.Fatal("no picture")
+	}
+	if got.Picture.MIMEType != mime || !bytes.Equal(got.Picture.Data, data) {
+		t.Errorf("picture = %s %q, want %s %q", got.Picture.MIMEType, got.Picture.Data, mime, data)
+	}
+}
+
+func TestReadMP3(t *testing.T) {
+	cover := []byte("\x89PNG cover")
+	tag := id3v23(
+		id3v23Frame("TIT2", []byte("\x00Caf\xe9")),
+		id3v23Frame("TPE1", utf16Text("Artist ☆")),
+		id3v23Frame("APIC", concat([]byte("\x00image/png\x00\x03desc\x00"), cover)),
+	)
+
+	// Constant bitrate: the duration follows from the stream size
+	b := concat(tag, mp3Frames(100, 0), id3v1("Ignored", "Ignored", "From v1"))
+	tags := readTags(t, b)
+	checkTags(t, tags, "Café", "Artist ☆", "From v1", time.Duration(100*417*8)*time.Second/128000)
+	checkPicture(t, tags, "image/png", cover)
+
+	// A Xing header gives the frame count
+	tags = readTags(t, concat(tag, mp3Frames(3, 1000)))
+	checkTags(t, tags, "Café", "Artist ☆", "", time.Duration(1000*1152)*time.Second/44100)
+}
+
+func TestReadFLAC(t *testing.T) {
+	cover := []byte("jpeg data")
+	b := concat([]byte("fLaC"),
+		flacBlock(flacStreamInfo, false, flacStreamInfoBlock(44100, 441000)),
+		flacBlock(flacVorbisComment, false, vorbisComment("title=Song", "ARTIST=Band", "Album=Record", "ARTIST=Second")),
+		flacBlock(flacPicture, true, flacPictureBlock(PictureFrontCover, "image/jpeg", cover)),
+		make([]byte, 32),
+	)
+	tags := readTags(t, b)
+	checkTags(t, tags, "Song", "Band", "Record", 10*time.Second)
+	checkPicture(t, tags, "image/jpeg", cover)
+
+	// Some taggers put an ID3v2 tag in front
+	tags = readTags(t, concat(id3v23(id3v23Frame("TIT2", []byte("\x00Other"))), b))
+	checkTags(t, tags, "Song", "Band", "Record", 10*time.Second)
+}
+
+func TestReadOgg(t *testing.T) {
+	// The picture makes the comment packet span several lacing segments
+	cover := bytes.Repeat([]byte("png"), 300)
+	picture := base64.StdEncoding.EncodeToString(flacPictureBlock(PictureFrontCover, "image/png", cover))
+
+	vorbisIdent := concat([]byte("\x01vorbis"), le32(0), []byte{2}, le32(44100), make([]byte, 14))
+	vorbis := concat(
+		oggPageBytes(7, 0, vorbisIdent),
+		oggPageBytes(7, 0, concat([]byte("\x03vorbis"), vorbisComment("TITLE=Ogg", "ARTIST=Vorbis", "METADATA_BLOCK_PICTURE="+picture))),
+		oggPageBytes(7, 44100, make([]byte, 100)),
+		oggPageBytes(7, 3*44100, make([]byte, 100)),
+	)
+	tags := readTags(t, vorbis)
+	checkTags(t, tags, "Ogg", "Vorbis", "", 3*time.Second)
+	checkPicture(t, tags, "image/png", cover)
+
+	// Opus counts at 48 kHz after the pre-skip
+	opusIdent := concat([]byte("OpusHead\x01\x02"), []byte{0x38, 0x01}, le32(44100), []byte{0, 0, 0})
+	opus := concat(
+		oggPageBytes(9, 0, opusIdent),
+		oggPageBytes(9, 0, concat([]byte("OpusTags"), vorbisComment("title=Opus", "album=Codec"))),
+		oggPageBytes(9, 2*48000+0x138, make([]byte, 100)),
+	)
+	checkTags(t, readTags(t, opus), "Opus", "", "Codec", 2*time.Second)
+}
+
+func TestReadMP4(t *testing.T) {
+	cover := []byte("png cover")
+	b := mp4File(42, []string{"soun"},
+		mp4Item("\xa9nam", 1, []byte("Title")),
+		mp4Item("\xa9ART", 1, []byte("Track Artist")),
+		mp4Item("aART", 1, []byte("Album Artist")),
+		mp4Item("\xa9alb", 1, []byte("Album")),
+		mp4Item("trkn", 0, []byte{0, 0, 0, 1, 0, 9, 0, 0}),
+		mp4Item("covr", 14, cover),
+	)
+	tags := readTags(t, b)
+	checkTags(t, tags, "Title", "Track Artist", "Album", 42*time.Second)
+	checkPicture(t, tags, "image/png", cover)
+
+	// Without metadata only the duration is known
+	checkTags(t, readTags(t, mp4File(5, []string{"soun"})), "", "", "", 5*time.Second)
+}
+
+func TestReadWAV(t *testing.T) {
+	info := concat([]byte("INFO"), riffChunk("INAM", []byte("Odd\x00")), riffChunk("IART", []byte("Wave\x00")), riffChunk("IPRD", []byte("Riff")))
+	b := wavFile(8000, 16000, riffChunk("LIST", info))
+	checkTags(t, readTags(t, b), "Odd", "Wave", "Riff", 2*time.Second)
+
+	// Tags can also come in an ID3 chunk
+	id3 := id3v23(id3v23Frame("TIT2", []byte("\x03Tagged")), id3v23Frame("TALB", []byte("\x00Album")))
+	b = wavFile(8000, 4000, riffChunk("id3 ", id3))
+	checkTags(t, readTags(t, b), "Tagged", "", "Album", 500*time.Millisecond)
+}
+
+func TestReadTruncated(t *testing.T) {
+	flac := concat([]byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComment("TITLE=Cut")))
+	for i, b := range [][]byte{
+		flac[:len(flac)-3],
+		concat([]byte("fLaC"), flacBlock(flacStreamInfo, true, make([]byte, 10))),
+		oggPageBytes(1, 0, concat([]byte("\x01vorbis"), make([]byte, 23))),
+	} {
+		if _, err := ReadTags(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Errorf("file %d: ReadTags succeeded on a truncated file", i)
+		}
+	}
+}
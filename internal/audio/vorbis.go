@@ -0,0 +1,58 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var errShortComment = errors.New("truncated vorbis comment")
+
+// parseVorbisComment reads a Vorbis comment block as used by FLAC, Ogg
+// Vorbis and Opus and copies the known fields into tags.
+func parseVorbisComment(b []byte, tags *Tags) error {
+	next := func() ([]byte, error) {
+		if len(b) < 4 {
+			return nil, errShortComment
+		}
+		n := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if uint64(n) > uint64(len(b)) {
+			return nil, errShortComment
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+
+	if _, err := next(); err != nil { // vendor string
+		return err
+	}
+	if len(b) < 4 {
+		return errShortComment
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+
+	for i := uint32(0); i < count; i++ {
+		field, err := next()
+		if err != nil {
+			return err
+		}
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			setIfEmpty(&tags.Title, value)
+		case "ARTIST":
+			setIfEmpty(&tags.Artist, value)
+		case "ALBUM":
+			setIfEmpty(&tags.Album, value)
+		case "METADATA_BLOCK_PICTURE":
+			tags.addPicture(parseBase64Picture(value))
+		}
+	}
+	return nil
+}
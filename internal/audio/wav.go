@@ -0,0 +1,91 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// readWAV reads RIFF INFO tags (or an embedded ID3 chunk) and computes the
+// duration from the fmt and data chunks.
+func readWAV(r io.ReaderAt, size int64) (*Tags, error) {
+	tags := &Tags{}
+	var byteRate, dataSize int64
+
+	for pos := int64(12); pos+8 <= size; {
+		header, err := readAt(r, pos, 8)
+		if err != nil {
+			return nil, err
+		}
+		id := string(header[:4])
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		body := pos + 8
+		if body+length > size {
+			length = size - body
+		}
+
+		switch id {
+		case "fmt ":
+			if length >= 12 {
+				b, err := readAt(r, body, 12)
+				if err != nil {
+					return nil, err
+				}
+				byteRate = int64(binary.LittleEndian.Uint32(b[8:12]))
+			}
+		case "data":
+			dataSize = length
+		case "LIST":
+			b, err := readAt(r, body, int(length))
+			if err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(b, []byte("INFO")) {
+				parseRIFFInfo(b[4:], tags)
+			}
+		case "id3 ", "ID3 ":
+			b, err := readAt(r, body, int(length))
+			if err != nil {
+				return nil, err
+			}
+			frames, err := readID3v2(bytes.NewReader(b))
+			if err == nil {
+				applyID3v2(frames, tags)
+			}
+		}
+
+		pos = body + length + length%2 // Chunks are word aligned
+	}
+
+	if byteRate > 0 {
+		tags.Duration = durationFromSamples(dataSize, byteRate)
+	}
+	return tags, nil
+}
+
+func parseRIFFInfo(b []byte, tags *Tags) {
+	for len(b) >= 8 {
+		id := string(b[:4])
+		length := int(binary.LittleEndian.Uint32(b[4:8]))
+		if length > len(b)-8 {
+			return
+		}
+		value := b[8 : 8+length]
+		if i := bytes.IndexByte(value, 0); i >= 0 {
+			value = value[:i]
+		}
+		switch id {
+		case "INAM":
+			setIfEmpty(&tags.Title, string(value))
+		case "IART":
+			setIfEmpty(&tags.Artist, string(value))
+		case "IPRD":
+			setIfEmpty(&tags.Album, string(value))
+		}
+		next := 8 + length + length%2 // Word aligned
+		if next > len(b) {
+			return
+		}
+		b = b[next:]
+	}
+}
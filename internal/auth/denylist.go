@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gorm.io/gorm"
+)
+
+// RevocationSource returns the revoked access tokens that have not expired
+// yet, by jti, with their expiry.
+type RevocationSource func(ctx context.Context) (map[string]time.Time, error)
+
+// LocalRevocations reads revocations from the Auth service database.
+func LocalRevocations(db *gorm.DB) RevocationSource {
+	return func(ctx context.Context) (map[string]time.Time, error) {
+		return RevokedTokens(db.WithContext(ctx), time.Now())
+	}
+}
+
+// ServiceTokenHeader carries the token shared by the services on calls
+// between them.
+const ServiceTokenHeader = "x-service-token"
+
+// RemoteRevocations asks the Auth service for revocations, authenticating
+// with serviceToken.
+func RemoteRevocations(client pb.AuthServiceClient, serviceToken string) RevocationSource {
+	return func(ctx context.Context) (map[string]time.Time, error) {
+		ctx = metadata.AppendToOutgoingContext(ctx, ServiceTokenHeader, serviceToken)
+		resp, err := client.GetRevokedTokens(ctx, &emptypb.Empty{})
+		if err != nil {
+			return nil, err
+		}
+		revoked := make(map[string]time.Time, len(resp.Tokens))
+		for _, t := range resp.Tokens {
+			revoked[t.Jti] = t.ExpiresAt.AsTime()
+		}
+		return revoked, nil
+	}
+}
+
+// Denylist caches revoked access tokens so validating a token does not need
+// a round trip to the Auth service. Revocations take effect once the list is
+// reloaded; if the source is unreachable the last list is kept.
+type Denylist struct {
+	source RevocationSource
+
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewDenylist(source RevocationSource) *Denylist {
+	return &Denylist{source: source, revoked: make(map[string]time.Time)}
+}
+
+// Revoked reports whether the token with the given jti was revoked.
+func (d *Denylist) Revoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.revoked[jti]
+	return ok
+}
+
+// Reload replaces the cached list with the current revocations.
+func (d *Denylist) Reload(ctx context.Context) error {
+	revoked, err := d.source(ctx)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.revoked = revoked
+	d.mu.Unlock()
+	return nil
+}
+
+// Run reloads the list now and then every interval until ctx is cancelled.
+func (d *Denylist) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reloadCtx, cancel := context.WithTimeout(ctx, interval)
+		if err := d.Reload(reloadCtx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to reload token denylist: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Limits on client-supplied device fields
+const (
+	maxDeviceNameLength  = 100
+	maxDeviceFieldLength = 50
+)
+
+func (s *Server) RegisterDevice(ctx context.Context, req *pb.RegisterDeviceRequest) (*pb.RegisterDeviceResponse, error) {
+	username, err := usernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "device name is required")
+	}
+	if len(req.Name) > maxDeviceNameLength || len(req.Platform) > maxDeviceFieldLength || len(req.AppVersion) > maxDeviceFieldLength {
+		return nil, status.Errorf(codes.InvalidArgument, "device fields are too long")
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate device id")
+	}
+	device := Device{
+		ID:          id,
+		Username:    username,
+		Name:        req.Name,
+		Platform:    req.Platform,
+		AppVersion:  req.AppVersion,
+		LastLoginAt: time.Now(),
+	}
+	if err := s.DB.Create(&device).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to register device")
+	}
+
+	issued, err := s.issueTokens(s.DB, username, device.ID, "")
+	if err == errAccountDisabled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token")
+	}
+
+	return &pb.RegisterDeviceResponse{
+		DeviceId:     device.ID,
+		Token:        issued.Token,
+		RefreshToken: issued.RefreshToken,
+		ExpiresAt:    timestamppb.New(issued.ExpiresAt),
+	}, nil
+}
+
+func (s *Server) ListDevices(ctx context.Context, req *emptypb.Empty) (*pb.ListDevicesResponse, error) {
+	username, err := usernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	if err := s.DB.Where("username = ?", username).Order("created_at").Find(&devices).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+
+	resp := &pb.ListDevicesResponse{}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, &pb.Device{
+			DeviceId:    d.ID,
+			Name:        d.Name,
+			Platform:    d.Platform,
+			AppVersion:  d.AppVersion,
+			CreatedAt:   timestamppb.New(d.CreatedAt),
+			LastLoginAt: timestamppb.New(d.LastLoginAt),
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) RevokeDevice(ctx context.Context, req *pb.RevokeDeviceRequest) (*emptypb.Empty, error) {
+	username, err := usernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.DB.Where("id = ? AND username = ?", req.DeviceId, username).Delete(&Device{})
+	if result.Error != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.Errorf(codes.NotFound, "device not found")
+	}
+
+	if err := revokeSessions(s.DB, time.Now(), "device_id = ? AND username = ?", req.DeviceId, username); err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	s.reloadDenylist(ctx)
+	return &emptypb.Empty{}, nil
+}
+
+// usernameFromContext returns the caller authenticated by the interceptor.
+func usernameFromContext(ctx context.Context) (string, error) {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	return claims.Username, nil
+}
+
+// newID returns a random identifier for devices and token families.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
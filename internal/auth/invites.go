@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const maxInviteUses = 1000
+
+var validRoles = map[string]bool{RoleAdmin: true, RoleUser: true, RoleGuest: true}
+
+var errInvalidInvite = status.Errorf(codes.PermissionDenied, "invalid, expired or used up invite code")
+
+func (s *Server) CreateInvite(ctx context.Context, req *pb.CreateInviteRequest) (*pb.CreateInviteResponse, error) {
+	username, err := s.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	if maxUses < 0 || maxUses > maxInviteUses {
+		return nil, status.Errorf(codes.InvalidArgument, "max_uses must be between 1 and %d", maxInviteUses)
+	}
+	if req.Role != "" && !validRoles[req.Role] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role %q", req.Role)
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := req.ExpiresAt.AsTime()
+		if !t.After(time.Now()) {
+			return nil, status.Errorf(codes.InvalidArgument, "expires_at must be in the future")
+		}
+		expiresAt = &t
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate invite")
+	}
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate invite")
+	}
+	code := base32.StdEncoding.EncodeToString(b)
+
+	invite := Invite{
+		ID:        id,
+		CodeHash:  hashSecret(code),
+		CreatedBy: username,
+		Role:      req.Role,
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.DB.Create(&invite).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	return &pb.CreateInviteResponse{Invite: inviteInfo(&invite), Code: code}, nil
+}
+
+func (s *Server) ListInvites(ctx context.Context, req *emptypb.Empty) (*pb.ListInvitesResponse, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var invites []Invite
+	if err := s.DB.Order("created_at DESC").Find(&invites).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	resp := &pb.ListInvitesResponse{}
+	for i := range invites {
+		resp.Invites = append(resp.Invites, inviteInfo(&invites[i]))
+	}
+	return resp, nil
+}
+
+func (s *Server) RevokeInvite(ctx context.Context, req *pb.RevokeInviteRequest) (*emptypb.Empty, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	result := s.DB.Model(&Invite{}).Where("id = ? AND revoked_at IS NULL", req.InviteId).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.Errorf(codes.NotFound, "invite not found")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// redeemInvite uses up one use of the invite with the given code.
+func redeemInvite(tx *gorm.DB, code string, now time.Time) (*Invite, error) {
+	var invite Invite
+	// Codes are base32, accept them typed in lower case
+	code = strings.ToUpper(strings.TrimSpace(code))
+	err := tx.Where("code_hash = ?", hashSecret(code)).First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked in the update so concurrent sign-ups cannot exceed max_uses
+	result := tx.Model(&Invite{}).
+		Where("id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND uses < max_uses", invite.ID, now).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidInvite
+	}
+	return &invite, nil
+}
+
+// requireAdmin returns the caller if their token carries the admin role.
+// Role changes revoke the user's tokens, so the claim is current.
+func (s *Server) requireAdmin(ctx context.Context) (string, error) {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if claims.Role != RoleAdmin {
+		return "", status.Errorf(codes.PermissionDenied, "admin role required")
+	}
+	return claims.Username, nil
+}
+
+// EnsureAdmin makes the oldest user an admin if there is no admin, which
+// is the case for databases created before roles existed.
+func EnsureAdmin(db *gorm.DB) error {
+	var admins int64
+	if err := db.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	var first User
+	err := db.Order("id").First(&first).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&first).Update("role", RoleAdmin).Error; err != nil {
+		return err
+	}
+	log.Printf("Made %s an admin", first.Username)
+	return nil
+}
+
+func inviteInfo(invite *Invite) *pb.Invite {
+	info := &pb.Invite{
+		InviteId:  invite.ID,
+		CreatedBy: invite.CreatedBy,
+		Role:      invite.Role,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		Revoked:   invite.RevokedAt != nil,
+		CreatedAt: timestamppb.New(invite.CreatedAt),
+	}
+	if invite.ExpiresAt != nil {
+		info.ExpiresAt = timestamppb.New(*invite.ExpiresAt)
+	}
+	return info
+}
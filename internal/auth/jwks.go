@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func (s *Server) GetPublicKeys(ctx context.Context, req *emptypb.Empty) (*pb.GetPublicKeysResponse, error) {
+	keys := s.Signer.PublicKeys()
+	resp := &pb.GetPublicKeysResponse{}
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key.Key)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode key %s", key.ID)
+		}
+		resp.Keys = append(resp.Keys, &pb.PublicKey{Kid: key.ID, Alg: key.Algorithm, PublicKey: der})
+	}
+	jwks, err := JWKS(keys)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode keys")
+	}
+	resp.Jwks = jwks
+	return resp, nil
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517, RFC 8037).
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS encodes keys as a JSON Web Key Set.
+func JWKS(keys []PublicKey) ([]byte, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+	for _, key := range keys {
+		k := jwk{Use: "sig", Alg: key.Algorithm, Kid: key.ID}
+		switch public := key.Key.(type) {
+		case ed25519.PublicKey:
+			k.Kty, k.Crv, k.X = "OKP", "Ed25519", b64(public)
+		case *rsa.PublicKey:
+			k.Kty, k.N, k.E = "RSA", b64(public.N.Bytes()), b64(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, k)
+	}
+	return json.Marshal(set)
+}
+
+// JWKSHandler serves the signer's public keys as a JSON Web Key Set.
+func JWKSHandler(signer Signer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := JWKS(signer.PublicKeys())
+		if err != nil {
+			http.Error(w, "failed to encode keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write(data)
+	})
+}
@@ -1,16 +1,82 @@
 package auth
 
 import (
-	"time"
+	"errors"
+	"fmt"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateToken(username string, secretKey string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
-	})
+// Signing algorithms for tokens issued by the Auth service
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+	// AlgHS256 signs with a secret shared by every service, so any of them
+	// can mint tokens
+	AlgHS256 = "HS256"
+)
+
+// Claims is the payload carried by tokens issued by the Auth service.
+type Claims struct {
+	Username string `json:"username"`
+	// DeviceID is set on tokens issued to a registered device
+	DeviceID string `json:"device_id,omitempty"`
+	// SessionID is the Session the token belongs to; the token's own ID is
+	// in the jti claim
+	SessionID string `json:"sid,omitempty"`
+	// Role is the user's role when the token was issued, empty on tokens
+	// issued before roles existed
+	Role string `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Signer signs the tokens issued by the Auth service.
+type Signer interface {
+	// Sign returns the signed token; the caller sets the expiry.
+	Sign(claims *Claims) (string, error)
+	// PublicKeys returns the keys verifying the signed tokens, none for
+	// shared secrets.
+	PublicKeys() []PublicKey
+}
+
+// Verifier returns the key verifying a token, chosen by its alg and kid
+// headers.
+type Verifier interface {
+	VerificationKey(token *jwt.Token) (interface{}, error)
+}
+
+// Secret signs and verifies HS256 tokens.
+type Secret []byte
+
+func (s Secret) Sign(claims *Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s))
+}
+
+func (s Secret) PublicKeys() []PublicKey {
+	return nil
+}
+
+func (s Secret) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if len(s) == 0 || token.Method != jwt.SigningMethodHS256 {
+		return nil, fmt.Errorf("unexpected signing algorithm %s", token.Method.Alg())
+	}
+	return []byte(s), nil
+}
 
-	return token.SignedString([]byte(secretKey))
+// ValidateToken parses a token verified by verifier and returns its claims.
+// Expired or malformed tokens are rejected.
+func ValidateToken(tokenString string, verifier Verifier) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, verifier.VerificationKey,
+		jwt.WithValidMethods([]string{AlgEdDSA, AlgRS256, AlgHS256}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Username == "" {
+		return nil, errors.New("token has no username")
+	}
+	return claims, nil
 }
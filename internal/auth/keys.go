@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const rsaKeyBits = 2048
+
+// SigningKey is a private key of the Auth service.
+type SigningKey struct {
+	ID        string // kid header of the tokens it signs
+	Algorithm string // AlgEdDSA or AlgRS256
+	Created   time.Time
+	Private   crypto.Signer
+}
+
+// PublicKey verifies the tokens signed by a SigningKey.
+type PublicKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.PublicKey // ed25519.PublicKey or *rsa.PublicKey
+}
+
+func (k *SigningKey) Public() PublicKey {
+	return PublicKey{ID: k.ID, Algorithm: k.Algorithm, Key: k.Private.Public()}
+}
+
+// KeyStore keeps the signing keys of the Auth service in a directory, one
+// PEM file per key. The newest key signs; the others only verify, so tokens
+// signed before a rotation stay valid until they expire.
+type KeyStore struct {
+	dir string
+	// Legacy verifies HS256 tokens issued before switching to keys, may be
+	// empty
+	Legacy Secret
+
+	mu   sync.RWMutex
+	keys []*SigningKey // Newest first
+}
+
+// OpenKeyStore loads the keys in dir, creating the directory and a first
+// key using algorithm if there are none.
+func OpenKeyStore(dir, algorithm string) (*KeyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &KeyStore{dir: dir}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	if len(s.Keys()) == 0 {
+		key, err := s.Rotate(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated %s signing key %s in %s", key.Algorithm, key.ID, dir)
+	}
+	return s, nil
+}
+
+// Reload reads the keys from disk again, picking up keys added or removed
+// by another process.
+func (s *KeyStore) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	var keys []*SigningKey
+	for _, path := range paths {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.After(keys[j].Created) })
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Run reloads the keys every interval until ctx is cancelled.
+func (s *KeyStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				log.Printf("Failed to reload signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// Rotate generates a key using algorithm, which signs from now on.
+func (s *KeyStore) Rotate(algorithm string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := keyID(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: id, Algorithm: algorithm, Created: time.Now().UTC(), Private: private}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{"Created": key.Created.Format(time.RFC3339Nano)},
+		Bytes:   der,
+	})
+	if err := os.WriteFile(filepath.Join(s.dir, id+".pem"), data, 0o600); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.keys = append([]*SigningKey{key}, s.keys...)
+	s.mu.Unlock()
+	return key, nil
+}
+
+// Remove deletes a key that no longer signs. Tokens it signed stop
+// verifying.
+func (s *KeyStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+		if i == 0 {
+			return errors.New("cannot remove the current signing key, rotate first")
+		}
+		if err := os.Remove(filepath.Join(s.dir, id+".pem")); err != nil {
+			return err
+		}
+		s.keys = append(s.keys[:i:i], s.keys[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("key %s not found", id)
+}
+
+// Keys returns the keys, the signing key first.
+func (s *KeyStore) Keys() []*SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*SigningKey(nil), s.keys...)
+}
+
+func (s *KeyStore) PublicKeys() []PublicKey {
+	keys := s.Keys()
+	public := make([]PublicKey, len(keys))
+	for i, key := range keys {
+		public[i] = key.Public()
+	}
+	return public
+}
+
+func (s *KeyStore) Sign(claims *Claims) (string, error) {
+	keys := s.Keys()
+	if len(keys) == 0 {
+		return "", errors.New("no signing key")
+	}
+	key := keys[0]
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+func (s *KeyStore) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 {
+		return s.Legacy.VerificationKey(token)
+	}
+	return matchKey(token, func(id string) (PublicKey, bool) {
+		for _, key := range s.Keys() {
+			if key.ID == id {
+				return key.Public(), true
+			}
+		}
+		return PublicKey{}, false
+	})
+}
+
+// matchKey returns the public key named by the token's kid header, provided
+// it is meant for the token's algorithm.
+func matchKey(token *jwt.Token, lookup func(id string) (PublicKey, bool)) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	if id == "" {
+		return nil, errors.New("token has no kid")
+	}
+	key, ok := lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+	if key.Algorithm != token.Method.Alg() {
+		return nil, fmt.Errorf("key %s is not for %s", id, token.Method.Alg())
+	}
+	return key.Key, nil
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PKCS #8 private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	created, err := time.Parse(time.RFC3339Nano, block.Headers["Created"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Created header: %w", err)
+	}
+
+	key := &SigningKey{Created: created}
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Private = AlgEdDSA, private
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Private = AlgRS256, private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if key.ID, err = keyID(key.Private.Public()); err != nil {
+		return nil, err
+	}
+	if name := strings.TrimSuffix(filepath.Base(path), ".pem"); name != key.ID {
+		return nil, fmt.Errorf("file name does not match key id %s", key.ID)
+	}
+	return key, nil
+}
+
+// keyID derives a key's kid from its public key.
+func keyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Tokens signed by an unknown key trigger a fetch at most this often, which
+// picks up rotated keys without letting bogus kids hammer the Auth service
+const minKeyFetchInterval = 10 * time.Second
+
+// KeySource returns the public keys verifying tokens.
+type KeySource func(ctx context.Context) ([]PublicKey, error)
+
+// RemotePublicKeys asks the Auth service for its public keys.
+func RemotePublicKeys(client pb.AuthServiceClient) KeySource {
+	return func(ctx context.Context) ([]PublicKey, error) {
+		resp, err := client.GetPublicKeys(ctx, &emptypb.Empty{})
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]PublicKey, 0, len(resp.Keys))
+		for _, k := range resp.Keys {
+			key, err := x509.ParsePKIXPublicKey(k.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+			}
+			keys = append(keys, PublicKey{ID: k.Kid, Algorithm: k.Alg, Key: key})
+		}
+		return keys, nil
+	}
+}
+
+// KeySet verifies tokens with public keys fetched from the Auth service, so
+// services other than Auth hold no signing material.
+type KeySet struct {
+	source KeySource
+	// Legacy verifies HS256 tokens, may be empty
+	Legacy Secret
+
+	mu      sync.RWMutex
+	keys    map[string]PublicKey
+	fetched time.Time
+
+	fetchMu sync.Mutex
+}
+
+func NewKeySet(source KeySource) *KeySet {
+	return &KeySet{source: source, keys: make(map[string]PublicKey)}
+}
+
+// Reload replaces the keys with the ones from the source. On failure the
+// known keys are kept.
+func (k *KeySet) Reload(ctx context.Context) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	k.mu.Lock()
+	k.fetched = time.Now()
+	k.mu.Unlock()
+
+	keys, err := k.source(ctx)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]PublicKey, len(keys))
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+	k.mu.Lock()
+	k.keys = byID
+	k.mu.Unlock()
+	return nil
+}
+
+// Run reloads the keys now and then every interval until ctx is cancelled.
+func (k *KeySet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reloadCtx, cancel := context.WithTimeout(ctx, interval)
+		if err := k.Reload(reloadCtx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to fetch public keys: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *KeySet) VerificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 {
+		return k.Legacy.VerificationKey(token)
+	}
+	return matchKey(token, func(id string) (PublicKey, bool) {
+		if key, ok := k.lookup(id); ok {
+			return key, true
+		}
+
+		// The key may have been added by a rotation since the last fetch
+		k.mu.RLock()
+		stale := time.Since(k.fetched) >= minKeyFetchInterval
+		k.mu.RUnlock()
+		if !stale {
+			return PublicKey{}, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := k.Reload(ctx); err != nil {
+			log.Printf("Failed to fetch public keys: %v", err)
+		}
+		return k.lookup(id)
+	})
+}
+
+func (k *KeySet) lookup(id string) (PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
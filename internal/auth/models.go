@@ -1,11 +1,94 @@
 package auth
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// Roles of a user
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+	RoleGuest = "guest"
+)
+
 type User struct {
 	gorm.Model
 	Username string `gorm:"uniqueIndex"`
 	Password string
+	Role     string `gorm:"default:user"`
+	// InviteID is the invite the user signed up with, empty otherwise
+	InviteID string `gorm:"index"`
+	// DisabledAt is set while an admin has disabled the account
+	DisabledAt *time.Time
+}
+
+// Device is a client installation registered by a user. Revoking a device
+// soft-deletes it.
+type Device struct {
+	ID          string `gorm:"primaryKey"`
+	Username    string `gorm:"index"`
+	Name        string
+	Platform    string
+	AppVersion  string
+	LastLoginAt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+// Session is a login: the tokens issued by Register, Login or RegisterDevice
+// and every token refreshed from them. Its ID is the sid claim of its access
+// tokens and the FamilyID of its refresh tokens.
+type Session struct {
+	ID         string `gorm:"primaryKey"`
+	Username   string `gorm:"index"`
+	DeviceID   string `gorm:"index"`
+	LastUsedAt time.Time
+	// ExpiresAt is when the latest refresh token of the session expires
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// IssuedToken is the jti of an access token, kept until the token expires so
+// revoking its session can deny it.
+type IssuedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	SessionID string    `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+	// RevokedAt denies the token alone, leaving its session usable, so
+	// clients refresh and get a token with up to date claims
+	RevokedAt *time.Time
+}
+
+// RefreshToken is a single-use token exchanged for new tokens by Refresh.
+// Only a hash of the token is stored. Tokens descending from the same login
+// share a FamilyID, so presenting an already used token revokes all of them.
+type RefreshToken struct {
+	Hash      string `gorm:"primaryKey"`
+	FamilyID  string `gorm:"index"`
+	Username  string `gorm:"index"`
+	DeviceID  string `gorm:"index"`
+	ExpiresAt time.Time
+	// UsedAt is set once the token was exchanged
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Invite lets people sign up until it is used up, expires or is revoked.
+// Only a hash of the code is stored; the code is shown once on creation.
+type Invite struct {
+	ID        string `gorm:"primaryKey"`
+	CodeHash  string `gorm:"uniqueIndex"`
+	CreatedBy string `gorm:"index"`
+	// Role given to users signing up with the invite
+	Role      string
+	MaxUses   int32
+	Uses      int32
+	ExpiresAt *time.Time // Nil for no expiry
+	RevokedAt *time.Time
+	CreatedAt time.Time
 }
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// tokens is an access token with the refresh token that renews it.
+type tokens struct {
+	Token        string
+	RefreshToken string
+	ExpiresAt    time.Time // Of the access token
+}
+
+var (
+	errInvalidRefreshToken = status.Errorf(codes.Unauthenticated, "invalid or expired refresh token")
+	errAccountDisabled     = status.Errorf(codes.PermissionDenied, "account is disabled")
+)
+
+func (s *Server) Refresh(ctx context.Context, req *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	now := time.Now()
+	var issued *tokens
+	var reused *RefreshToken
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var current RefreshToken
+		err := tx.Where("hash = ?", hashSecret(req.RefreshToken)).First(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if current.RevokedAt != nil || !now.Before(current.ExpiresAt) {
+			return errInvalidRefreshToken
+		}
+
+		// Claiming the token fails if it was exchanged before, which means
+		// it leaked: whoever holds the newer tokens may be an attacker, so
+		// the whole family is revoked
+		result := tx.Model(&RefreshToken{}).Where("hash = ? AND used_at IS NULL", current.Hash).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = &current
+			return revokeSessions(tx, now, "id = ?", current.FamilyID)
+		}
+
+		if current.DeviceID != "" {
+			// Revoked devices are soft-deleted and not found here
+			var devices int64
+			err := tx.Model(&Device{}).Where("id = ? AND username = ?", current.DeviceID, current.Username).Count(&devices).Error
+			if err != nil {
+				return err
+			}
+			if devices == 0 {
+				return errInvalidRefreshToken
+			}
+		}
+
+		issued, err = s.issueTokens(tx, current.Username, current.DeviceID, current.FamilyID)
+		return err
+	})
+	if reused != nil {
+		log.Printf("Refresh token reused for user %s, revoked session %s", reused.Username, reused.FamilyID)
+		s.reloadDenylist(ctx)
+		return nil, errInvalidRefreshToken
+	}
+	if code := status.Code(err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to refresh token")
+	}
+
+	return &pb.RefreshResponse{
+		Token:        issued.Token,
+		RefreshToken: issued.RefreshToken,
+		ExpiresAt:    timestamppb.New(issued.ExpiresAt),
+	}, nil
+}
+
+// issueTokens issues an access token and a refresh token in sessionID, or
+// in a new session if sessionID is empty. Expired tokens and sessions are
+// cleaned up on the way. Disabled and deleted users get errAccountDisabled.
+func (s *Server) issueTokens(db *gorm.DB, username, deviceID, sessionID string) (*tokens, error) {
+	var user User
+	err := db.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errAccountDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, errAccountDisabled
+	}
+
+	now := time.Now()
+	jti, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	newSession := sessionID == ""
+	if newSession {
+		if sessionID, err = newID(); err != nil {
+			return nil, err
+		}
+	}
+
+	expiresAt := now.Add(s.Config.AccessTokenTTL)
+	token, err := s.Signer.Sign(&Claims{
+		Username:  username,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+		Role:      user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+	refreshExpiresAt := now.Add(s.Config.RefreshTokenTTL)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ? AND expires_at < ?", username, now).Delete(&RefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("username = ? AND expires_at < ?", username, now).Delete(&Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("expires_at < ?", now).Delete(&IssuedToken{}).Error; err != nil {
+			return err
+		}
+
+		if newSession {
+			err = tx.Create(&Session{
+				ID:         sessionID,
+				Username:   username,
+				DeviceID:   deviceID,
+				LastUsedAt: now,
+				ExpiresAt:  refreshExpiresAt,
+			}).Error
+		} else {
+			err = tx.Model(&Session{}).Where("id = ?", sessionID).
+				Updates(map[string]interface{}{"last_used_at": now, "expires_at": refreshExpiresAt}).Error
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&IssuedToken{JTI: jti, SessionID: sessionID, ExpiresAt: expiresAt}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&RefreshToken{
+			Hash:      hashSecret(refreshToken),
+			FamilyID:  sessionID,
+			Username:  username,
+			DeviceID:  deviceID,
+			ExpiresAt: refreshExpiresAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tokens{Token: token, RefreshToken: refreshToken, ExpiresAt: expiresAt}, nil
+}
+
+// hashSecret returns the hash under which refresh tokens and invite codes
+// are stored.
+func hashSecret(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
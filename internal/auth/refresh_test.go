@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/config"
+	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	database, err := db.Connect(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AutoMigrate(&User{}, &Device{}, &Session{}, &IssuedToken{}, &RefreshToken{}, &Invite{}); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		DB: database,
+		Config: &config.Config{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: time.Hour,
+		},
+		Signer: Secret("test secret"),
+	}
+}
+
+func tokenID(t *testing.T, token string) string {
+	t.Helper()
+	claims, err := ValidateToken(token, Secret("test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.ID
+}
+
+func TestRefreshRotates(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	registered, err := s.Register(ctx, &pb.RegisterRequest{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken := registered.RefreshToken
+	for i := 0; i < 3; i++ {
+		resp, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: refreshToken})
+		if err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+		if resp.RefreshToken == refreshToken {
+			t.Fatalf("refresh %d returned the same refresh token", i)
+		}
+		if claims, err := ValidateToken(resp.Token, Secret("test secret")); err != nil || claims.Username != "alice" {
+			t.Fatalf("refresh %d returned token for %v: %v", i, claims, err)
+		}
+		refreshToken = resp.RefreshToken
+	}
+
+	if _, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: "unknown"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unknown refresh token: got %v, want Unauthenticated", err)
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	registered, err := s.Register(ctx, &pb.RegisterRequest{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: registered.RefreshToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another session of the same user is not affected
+	other, err := s.Login(ctx, &pb.LoginRequest{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exchanging the first refresh token again means it leaked
+	_, err = s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: registered.RefreshToken})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("reused refresh token: got %v, want Unauthenticated", err)
+	}
+
+	// The tokens issued from it are revoked along with it
+	_, err = s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: refreshed.RefreshToken})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("refresh token issued before the reuse: got %v, want Unauthenticated", err)
+	}
+	revoked, err := RevokedTokens(s.DB, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"registered": registered.Token, "refreshed": refreshed.Token} {
+		if _, ok := revoked[tokenID(t, token)]; !ok {
+			t.Errorf("%s access token is not revoked", name)
+		}
+	}
+	if _, ok := revoked[tokenID(t, other.Token)]; ok {
+		t.Error("access token of another session is revoked")
+	}
+	if _, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: other.RefreshToken}); err != nil {
+		t.Errorf("refresh in another session: %v", err)
+	}
+}
@@ -3,12 +3,15 @@ package auth
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"gorm.io/gorm"
 )
 
@@ -16,13 +19,15 @@ type Server struct {
 	pb.UnimplementedAuthServiceServer
 	DB     *gorm.DB
 	Config *config.Config
+	// Signer signs issued access tokens
+	Signer Signer
+	// Denylist is reloaded right after tokens are revoked, may be nil
+	Denylist *Denylist
+	// Files purges the data of deleted users
+	Files filepb.FileServiceClient
 }
 
 func (s *Server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
-	if req.SecurityKey != s.Config.SecurityKey {
-		return nil, status.Errorf(codes.PermissionDenied, "invalid security key")
-	}
-
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to hash password")
@@ -31,21 +36,59 @@ func (s *Server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Reg
 	user := User{
 		Username: req.Username,
 		Password: string(hashedPassword),
+		Role:     RoleUser,
 	}
 
-	if err := s.DB.Create(&user).Error; err != nil {
-		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			return nil, status.Errorf(codes.AlreadyExists, "username already taken")
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var users int64
+		if err := tx.Model(&User{}).Count(&users).Error; err != nil {
+			return err
+		}
+
+		switch {
+		case req.InviteCode != "":
+			invite, err := redeemInvite(tx, req.InviteCode, time.Now())
+			if err != nil {
+				return err
+			}
+			user.InviteID = invite.ID
+			if invite.Role != "" {
+				user.Role = invite.Role
+			}
+		case s.Config.SecurityKey != "" && req.SecurityKey == s.Config.SecurityKey:
+			// The legacy shared key, kept to bootstrap new installations
+		case s.Config.SecurityKey == "" && users == 0:
+			// Without a shared key the first user needs no invite
+		default:
+			return status.Errorf(codes.PermissionDenied, "an invite code is required")
 		}
+
+		// The first user administers the server
+		if users == 0 {
+			user.Role = RoleAdmin
+		}
+		return tx.Create(&user).Error
+	})
+	if status.Code(err) == codes.PermissionDenied {
+		return nil, err
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, status.Errorf(codes.AlreadyExists, "username already taken")
+	}
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create user")
 	}
 
-	token, err := GenerateToken(user.Username, s.Config.SecretKey)
+	issued, err := s.issueTokens(s.DB, user.Username, "", "")
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate token")
 	}
 
-	return &pb.RegisterResponse{Token: token}, nil
+	return &pb.RegisterResponse{
+		Token:        issued.Token,
+		RefreshToken: issued.RefreshToken,
+		ExpiresAt:    timestamppb.New(issued.ExpiresAt),
+	}, nil
 }
 
 func (s *Server) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
@@ -60,11 +103,30 @@ func (s *Server) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResp
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "invalid credentials")
 	}
+	if user.DisabledAt != nil {
+		return nil, errAccountDisabled
+	}
+
+	if req.DeviceId != "" {
+		// Revoked devices are soft-deleted and not found here
+		result := s.DB.Model(&Device{}).Where("id = ? AND username = ?", req.DeviceId, user.Username).
+			Update("last_login_at", time.Now())
+		if result.Error != nil {
+			return nil, status.Errorf(codes.Internal, "database error")
+		}
+		if result.RowsAffected == 0 {
+			return nil, status.Errorf(codes.PermissionDenied, "unknown or revoked device")
+		}
+	}
 
-	token, err := GenerateToken(user.Username, s.Config.SecretKey)
+	issued, err := s.issueTokens(s.DB, user.Username, req.DeviceId, "")
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate token")
 	}
 
-	return &pb.LoginResponse{Token: token}, nil
+	return &pb.LoginResponse{
+		Token:        issued.Token,
+		RefreshToken: issued.RefreshToken,
+		ExpiresAt:    timestamppb.New(issued.ExpiresAt),
+	}, nil
 }
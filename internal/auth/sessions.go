@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+func (s *Server) Logout(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if claims.SessionID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "token has no session, log in again")
+	}
+
+	if err := revokeSessions(s.DB, time.Now(), "id = ? AND username = ?", claims.SessionID, claims.Username); err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	s.reloadDenylist(ctx)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListSessions(ctx context.Context, req *emptypb.Empty) (*pb.ListSessionsResponse, error) {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	var sessions []Session
+	err := s.DB.Where("username = ? AND revoked_at IS NULL AND expires_at > ?", claims.Username, time.Now()).
+		Order("created_at").Find(&sessions).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+
+	resp := &pb.ListSessionsResponse{}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			SessionId:  session.ID,
+			DeviceId:   session.DeviceID,
+			CreatedAt:  timestamppb.New(session.CreatedAt),
+			LastUsedAt: timestamppb.New(session.LastUsedAt),
+			ExpiresAt:  timestamppb.New(session.ExpiresAt),
+			Current:    session.ID == claims.SessionID,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*emptypb.Empty, error) {
+	username, err := usernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	err = s.DB.Model(&Session{}).Where("id = ? AND username = ? AND revoked_at IS NULL", req.SessionId, username).Count(&count).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	if count == 0 {
+		return nil, status.Errorf(codes.NotFound, "session not found")
+	}
+	if err := revokeSessions(s.DB, time.Now(), "id = ? AND username = ?", req.SessionId, username); err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	s.reloadDenylist(ctx)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) GetRevokedTokens(ctx context.Context, req *emptypb.Empty) (*pb.GetRevokedTokensResponse, error) {
+	// Only the other services may list revocations; they present the
+	// shared service token instead of a user's token
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := firstValue(md, ServiceTokenHeader)
+	if s.Config.ServiceToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.ServiceToken)) != 1 {
+		return nil, status.Errorf(codes.PermissionDenied, "a valid service token is required")
+	}
+
+	revoked, err := RevokedTokens(s.DB, time.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	resp := &pb.GetRevokedTokensResponse{}
+	for jti, expiresAt := range revoked {
+		resp.Tokens = append(resp.Tokens, &pb.RevokedToken{Jti: jti, ExpiresAt: timestamppb.New(expiresAt)})
+	}
+	return resp, nil
+}
+
+// RevokedTokens returns the access tokens that were revoked, on their own or
+// with their session, and have not expired yet, by jti.
+func RevokedTokens(db *gorm.DB, now time.Time) (map[string]time.Time, error) {
+	var tokens []IssuedToken
+	err := db.Joins("JOIN sessions ON sessions.id = issued_tokens.session_id").
+		Where("(sessions.revoked_at IS NOT NULL OR issued_tokens.revoked_at IS NOT NULL) AND issued_tokens.expires_at > ?", now).
+		Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]time.Time, len(tokens))
+	for _, t := range tokens {
+		revoked[t.JTI] = t.ExpiresAt
+	}
+	return revoked, nil
+}
+
+// revokeSessions revokes the sessions matching the conditions along with
+// their refresh tokens. Their access tokens show up in RevokedTokens.
+func revokeSessions(db *gorm.DB, now time.Time, query interface{}, args ...interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []string
+		if err := tx.Model(&Session{}).Where(query, args...).Where("revoked_at IS NULL").Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.Model(&Session{}).Where("id IN ?", ids).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).Where("family_id IN ? AND revoked_at IS NULL", ids).Update("revoked_at", now).Error
+	})
+}
+
+// revokeAccessTokens revokes the unexpired access tokens of the user without
+// ending their sessions.
+func revokeAccessTokens(db *gorm.DB, now time.Time, username string) error {
+	return db.Model(&IssuedToken{}).
+		Where("revoked_at IS NULL AND expires_at > ? AND session_id IN (?)", now,
+			db.Model(&Session{}).Select("id").Where("username = ?", username)).
+		Update("revoked_at", now).Error
+}
+
+// reloadDenylist makes revocations take effect on this service right away;
+// the other services pick them up on their next poll.
+func (s *Server) reloadDenylist(ctx context.Context) {
+	if s.Denylist == nil {
+		return
+	}
+	if err := s.Denylist.Reload(ctx); err != nil {
+		log.Printf("Failed to reload token denylist: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/auth"
+	filepb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+func (s *Server) ListUsers(ctx context.Context, req *emptypb.Empty) (*pb.ListUsersResponse, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := s.DB.Order("username").Find(&users).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	resp := &pb.ListUsersResponse{}
+	for i := range users {
+		resp.Users = append(resp.Users, userInfo(&users[i]))
+	}
+	return resp, nil
+}
+
+func (s *Server) SetUserDisabled(ctx context.Context, req *pb.SetUserDisabledRequest) (*pb.User, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var user *User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findUser(tx, req.Username); err != nil {
+			return err
+		}
+		if !req.Disabled {
+			user.DisabledAt = nil
+			return tx.Model(user).Update("disabled_at", nil).Error
+		}
+		return disableUser(tx, user, time.Now())
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	s.reloadDenylist(ctx)
+	return userInfo(user), nil
+}
+
+func (s *Server) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*emptypb.Empty, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.NewPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "new_password is required")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash password")
+	}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		user, err := findUser(tx, req.Username)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("password", string(hashedPassword)).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, time.Now(), "username = ?", user.Username)
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	s.reloadDenylist(ctx)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.User, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if !validRoles[req.Role] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role %q", req.Role)
+	}
+
+	var user *User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findUser(tx, req.Username); err != nil {
+			return err
+		}
+		if user.Role == req.Role {
+			return nil
+		}
+		if req.Role != RoleAdmin {
+			if err := keepAdmin(tx, user); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(user).Update("role", req.Role).Error; err != nil {
+			return err
+		}
+		user.Role = req.Role
+		// Tokens carry the role; revoking them makes clients refresh into
+		// tokens with the new one
+		return revokeAccessTokens(tx, time.Now(), user.Username)
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	s.reloadDenylist(ctx)
+	return userInfo(user), nil
+}
+
+func (s *Server) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	if _, err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.Files == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "file service is not configured")
+	}
+
+	// The account is disabled first so nothing is added while its data is
+	// purged; if purging fails it stays disabled and the call can be retried
+	var user *User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findUser(tx, req.Username); err != nil {
+			return err
+		}
+		return disableUser(tx, user, time.Now())
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	s.reloadDenylist(ctx)
+
+	// The File service checks the admin's token too, so it is passed on
+	md, _ := metadata.FromIncomingContext(ctx)
+	purgeCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", firstValue(md, "authorization")))
+	purged, err := s.Files.PurgeUser(purgeCtx, &filepb.PurgeUserRequest{Username: user.Username})
+	if err != nil {
+		log.Printf("Failed to purge data of user %s: %v", user.Username, err)
+		return nil, status.Errorf(codes.Unavailable, "failed to delete the user's library, the account stays disabled")
+	}
+
+	// Deleted for good so the username can be taken again. Sessions stay
+	// revoked until they expire so their tokens remain denied.
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("username = ?", user.Username).Delete(&Device{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("username = ?", user.Username).Delete(&RefreshToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(user).Error
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "database error")
+	}
+	log.Printf("Deleted user %s and %d library entries", user.Username, purged.RemovedTracks)
+	return &pb.DeleteUserResponse{RemovedTracks: purged.RemovedTracks}, nil
+}
+
+// disableUser disables the account and ends its sessions, refusing to
+// disable the last admin.
+func disableUser(tx *gorm.DB, user *User, now time.Time) error {
+	if user.DisabledAt == nil {
+		if err := keepAdmin(tx, user); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("disabled_at", now).Error; err != nil {
+			return err
+		}
+		user.DisabledAt = &now
+	}
+	return revokeSessions(tx, now, "username = ?", user.Username)
+}
+
+// keepAdmin fails if user is the only enabled admin, who cannot be demoted,
+// disabled or deleted.
+func keepAdmin(tx *gorm.DB, user *User) error {
+	if user.Role != RoleAdmin || user.DisabledAt != nil {
+		return nil
+	}
+	var admins int64
+	err := tx.Model(&User{}).Where("role = ? AND disabled_at IS NULL AND id <> ?", RoleAdmin, user.ID).Count(&admins).Error
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return status.Errorf(codes.FailedPrecondition, "cannot remove the last admin")
+	}
+	return nil
+}
+
+func findUser(tx *gorm.DB, username string) (*User, error) {
+	var user User
+	err := tx.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// adminError passes status errors through and hides database errors.
+func adminError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal, "database error")
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func userInfo(user *User) *pb.User {
+	return &pb.User{
+		Username:  user.Username,
+		Role:      user.Role,
+		Disabled:  user.DisabledAt != nil,
+		InviteId:  user.InviteID,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+	}
+}
@@ -1,22 +1,61 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
 	DatabaseURL string
-	SecretKey   string
+	// SecretKey signs tokens with HS256 if SigningAlgorithm is HS256,
+	// otherwise it only verifies HS256 tokens issued before; may be empty
+	SecretKey string
+	// SecurityKey lets anyone knowing it sign up without an invite, empty
+	// to require invites
 	SecurityKey string
 	Port        string
+	// SigningAlgorithm is EdDSA, RS256 or HS256; the first two sign with
+	// keys kept in KeyDir
+	SigningAlgorithm string
+	KeyDir           string
+	// How often KeyDir is read again to pick up rotated keys
+	KeyRefreshInterval time.Duration
+	// Port serving the public keys as JWKS over HTTP, empty to disable
+	JWKSPort string
+	// AccessTokenTTL is how long issued JWTs are valid
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a refresh token stays usable; every refresh
+	// issues a new one
+	RefreshTokenTTL time.Duration
+	// How often the token denylist is reloaded
+	RevocationInterval time.Duration
+	// FileAddr is the File service, which deletes the data of deleted users
+	FileAddr string
+	// ServiceToken authenticates the other services fetching revoked
+	// tokens; empty refuses them
+	ServiceToken string
 }
 
 func LoadAuthConfig() *Config {
 	return &Config{
-		DatabaseURL: getEnv("DATABASE_URL", "auth.db"),
-		SecretKey:   getEnv("SECRET_KEY", "dev-secret-key"),
-		SecurityKey: getEnv("SECURITY_KEY", "dev-security-key"),
-		Port:        getEnv("PORT", "50051"),
+		DatabaseURL:     getEnv("DATABASE_URL", "auth.db"),
+		SecretKey:       getEnv("SECRET_KEY", ""),
+		SecurityKey:     getEnv("SECURITY_KEY", ""),
+		Port:            getEnv("PORT", "50051"),
+		AccessTokenTTL:  getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		RevocationInterval: getEnvDuration("REVOCATION_INTERVAL", 30*time.Second),
+
+		SigningAlgorithm:   getEnv("SIGNING_ALG", "EdDSA"),
+		KeyDir:             getEnv("KEY_DIR", "keys"),
+		KeyRefreshInterval: getEnvDuration("KEY_REFRESH_INTERVAL", 5*time.Minute),
+		JWKSPort:           getEnv("JWKS_PORT", ""),
+
+		FileAddr:     getEnv("FILE_ADDR", "localhost:50052"),
+		ServiceToken: getEnv("SERVICE_TOKEN", ""),
 	}
 }
 
@@ -26,3 +65,29 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid integer %q for %s, using %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
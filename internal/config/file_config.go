@@ -1,5 +1,13 @@
 package config
 
+import "time"
+
+// Tag precedence when client metadata and embedded tags disagree
+const (
+	TagPrecedenceClient = "client"
+	TagPrecedenceFile   = "file"
+)
+
 type FileConfig struct {
 	S3Endpoint  string
 	S3AccessKey string
@@ -7,7 +15,33 @@ type FileConfig struct {
 	S3Bucket    string
 	S3UseSSL    bool
 	DatabaseURL string
-	Port        string
+	// SecretKey verifies HS256 tokens if AcceptLegacyHS256 is set
+	SecretKey string
+	Port      string
+	// Largest accepted upload in bytes, 0 disables the limit
+	MaxUploadSize int64
+	// Whether client metadata or embedded tags win
+	TagPrecedence string
+	// Blob garbage collection
+	GCInterval    time.Duration
+	GCGracePeriod time.Duration
+	// Resumable uploads
+	UploadDir        string
+	UploadSessionTTL time.Duration
+	// How long sync changes are kept before clients must resync
+	ChangeRetention time.Duration
+	// Auth service address and how often revoked tokens and public keys
+	// are fetched from it
+	AuthAddr           string
+	RevocationInterval time.Duration
+	KeyRefreshInterval time.Duration
+	// ServiceToken authenticates this service to the Auth service, the
+	// same value as the Auth service's
+	ServiceToken string
+	// AcceptLegacyHS256 accepts HS256 tokens signed with SecretKey. Anyone
+	// holding the key can mint them, this service included, so it is only
+	// meant for migrating off HS256 signing
+	AcceptLegacyHS256 bool
 }
 
 func LoadFileConfig() *FileConfig {
@@ -18,6 +52,25 @@ func LoadFileConfig() *FileConfig {
 		S3Bucket:    getEnv("S3_BUCKET", "music"),
 		S3UseSSL:    getEnv("S3_USE_SSL", "false") == "true",
 		DatabaseURL: getEnv("DATABASE_URL", "metadata.db"),
+		SecretKey:   getEnv("SECRET_KEY", ""),
 		Port:        getEnv("PORT", "50052"),
+
+		MaxUploadSize: getEnvInt64("MAX_UPLOAD_SIZE", 1<<30),
+		TagPrecedence: getEnv("TAG_PRECEDENCE", TagPrecedenceClient),
+
+		GCInterval:    getEnvDuration("GC_INTERVAL", 10*time.Minute),
+		GCGracePeriod: getEnvDuration("GC_GRACE_PERIOD", time.Hour),
+
+		UploadDir:        getEnv("UPLOAD_DIR", "uploads"),
+		UploadSessionTTL: getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+
+		ChangeRetention: getEnvDuration("CHANGE_RETENTION", 30*24*time.Hour),
+
+		AuthAddr:           getEnv("AUTH_ADDR", "localhost:50051"),
+		ServiceToken:       getEnv("SERVICE_TOKEN", ""),
+		RevocationInterval: getEnvDuration("REVOCATION_INTERVAL", 30*time.Second),
+		KeyRefreshInterval: getEnvDuration("KEY_REFRESH_INTERVAL", 5*time.Minute),
+
+		AcceptLegacyHS256: getEnv("ACCEPT_LEGACY_HS256", "false") == "true",
 	}
 }
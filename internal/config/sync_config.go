@@ -1,13 +1,51 @@
 package config
 
+import "time"
+
 type SyncConfig struct {
 	DatabaseURL string
-	Port        string
+	// SecretKey verifies HS256 tokens if AcceptLegacyHS256 is set
+	SecretKey string
+	Port      string
+	// WatchLibrary: how often the change log is polled for writes by the
+	// File service and how often idle streams send a heartbeat
+	WatchPollInterval time.Duration
+	HeartbeatInterval time.Duration
+	// How often smart playlists are re-evaluated for the change feed
+	SmartPlaylistInterval time.Duration
+	// How long the state of a device that stopped calling is kept
+	DeviceStateTTL time.Duration
+	// Auth service address and how often revoked tokens and public keys
+	// are fetched from it
+	AuthAddr           string
+	RevocationInterval time.Duration
+	KeyRefreshInterval time.Duration
+	// ServiceToken authenticates this service to the Auth service, the
+	// same value as the Auth service's
+	ServiceToken string
+	// AcceptLegacyHS256 accepts HS256 tokens signed with SecretKey. Anyone
+	// holding the key can mint them, this service included, so it is only
+	// meant for migrating off HS256 signing
+	AcceptLegacyHS256 bool
 }
 
 func LoadSyncConfig() *SyncConfig {
 	return &SyncConfig{
 		DatabaseURL: getEnv("DATABASE_URL", "metadata.db"),
+		SecretKey:   getEnv("SECRET_KEY", ""),
 		Port:        getEnv("PORT", "50053"),
+
+		WatchPollInterval: getEnvDuration("WATCH_POLL_INTERVAL", 2*time.Second),
+		HeartbeatInterval: getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second),
+
+		SmartPlaylistInterval: getEnvDuration("SMART_PLAYLIST_INTERVAL", time.Minute),
+		DeviceStateTTL:        getEnvDuration("DEVICE_STATE_TTL", 90*24*time.Hour),
+
+		AuthAddr:           getEnv("AUTH_ADDR", "localhost:50051"),
+		ServiceToken:       getEnv("SERVICE_TOKEN", ""),
+		RevocationInterval: getEnvDuration("REVOCATION_INTERVAL", 30*time.Second),
+		KeyRefreshInterval: getEnvDuration("KEY_REFRESH_INTERVAL", 5*time.Minute),
+
+		AcceptLegacyHS256: getEnv("ACCEPT_LEGACY_HS256", "false") == "true",
 	}
 }
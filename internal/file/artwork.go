@@ -0,0 +1,247 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // Register PNG decoding for cover art
+	"io"
+	"log"
+	"strings"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/audio"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+	"github.com/minio/minio-go/v7"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Thumbnail sizes (longest edge in pixels), largest first so each one can be
+// scaled down from the previous.
+var artworkSizes = []int{512, 256, 128}
+
+const thumbnailQuality = 85
+
+// Embedded pictures are decoded in full, so their declared dimensions are
+// bounded before any pixels are allocated; a few kilobytes of PNG can claim
+// gigapixels.
+const (
+	maxArtworkEdge   = 8192
+	maxArtworkPixels = 40_000_000
+)
+
+// AlbumID identifies an album by artist and title.
+func AlbumID(artist, album string) string {
+	album = strings.ToLower(strings.TrimSpace(album))
+	if album == "" {
+		return ""
+	}
+	artist = strings.ToLower(strings.TrimSpace(artist))
+	sum := sha256.Sum256([]byte(artist + "\x00" + album))
+	return hex.EncodeToString(sum[:16])
+}
+
+func artworkKey(hash string, size int) string {
+	if size == 0 {
+		return "artwork/" + hash + "/original"
+	}
+	return fmt.Sprintf("artwork/%s/%d.jpg", hash, size)
+}
+
+// storeArtwork saves an embedded picture and its thumbnails, deduplicated by
+// content hash, and returns the artwork hash. Failures are logged and yield
+// an empty hash, they never fail the upload.
+func (s *Server) storeArtwork(ctx context.Context, picture *audio.Picture) string {
+	if picture == nil {
+		return ""
+	}
+	sum := sha256.Sum256(picture.Data)
+	hash := hex.EncodeToString(sum[:])
+
+	var count int64
+	if err := s.DB.Model(&Artwork{}).Where("hash = ?", hash).Count(&count).Error; err != nil {
+		log.Printf("Failed to look up artwork %s: %v", hash, err)
+		return ""
+	}
+	if count > 0 {
+		return hash
+	}
+
+	img, format, err := decodeArtwork(picture.Data)
+	if err != nil {
+		log.Printf("Skipping artwork %s: %v", hash, err)
+		return ""
+	}
+
+	mimeType := "image/" + format
+	_, err = s.MinioClient.PutObject(ctx, s.Config.S3Bucket, artworkKey(hash, 0), bytes.NewReader(picture.Data), int64(len(picture.Data)), minio.PutObjectOptions{
+		ContentType: mimeType,
+	})
+	if err != nil {
+		log.Printf("Failed to store artwork %s: %v", hash, err)
+		return ""
+	}
+
+	bounds := img.Bounds()
+	current := img
+	for _, size := range artworkSizes {
+		if size >= max(bounds.Dx(), bounds.Dy()) {
+			continue // Served from the original
+		}
+		current = fit(current, size)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, current, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			log.Printf("Failed to encode %dpx thumbnail for %s: %v", size, hash, err)
+			return ""
+		}
+		_, err := s.MinioClient.PutObject(ctx, s.Config.S3Bucket, artworkKey(hash, size), &buf, int64(buf.Len()), minio.PutObjectOptions{
+			ContentType: "image/jpeg",
+		})
+		if err != nil {
+			log.Printf("Failed to store %dpx thumbnail for %s: %v", size, hash, err)
+			return ""
+		}
+	}
+
+	artwork := Artwork{Hash: hash, MIMEType: mimeType, Width: bounds.Dx(), Height: bounds.Dy()}
+	if err := s.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&artwork).Error; err != nil {
+		log.Printf("Failed to save artwork %s: %v", hash, err)
+		return ""
+	}
+	return hash
+}
+
+// decodeArtwork decodes an embedded picture after checking that its
+// dimensions are within bounds.
+func decodeArtwork(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width > maxArtworkEdge || config.Height > maxArtworkEdge ||
+		int64(config.Width)*int64(config.Height) > maxArtworkPixels {
+		return nil, "", fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// fit scales src down so its longest edge is size pixels, averaging the
+// source pixels covered by each destination pixel.
+func fit(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := size, size
+	if w > h {
+		dh = max(1, h*size/w)
+	} else {
+		dw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := max(b.Min.Y+(y+1)*h/dh, y0+1)
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := max(b.Min.X+(x+1)*w/dw, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+func (s *Server) GetArtwork(req *pb.GetArtworkRequest, stream pb.FileService_GetArtworkServer) error {
+	username, err := interceptor.UsernameFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	var track Track
+	query := s.DB.Scopes(InLibrary(username)).Where("tracks.artwork_hash <> ''")
+	switch target := req.Target.(type) {
+	case *pb.GetArtworkRequest_TrackHash:
+		query = query.Where("tracks.hash = ?", target.TrackHash)
+	case *pb.GetArtworkRequest_AlbumId:
+		query = query.Where("tracks.album_id = ?", target.AlbumId)
+	default:
+		return status.Errorf(codes.InvalidArgument, "track_hash or album_id is required")
+	}
+	if err := query.First(&track).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return status.Errorf(codes.NotFound, "artwork not found")
+		}
+		return status.Errorf(codes.Internal, "failed to look up artwork: %v", err)
+	}
+
+	var artwork Artwork
+	if err := s.DB.Where("hash = ?", track.ArtworkHash).First(&artwork).Error; err != nil {
+		return status.Errorf(codes.NotFound, "artwork not found")
+	}
+
+	// Smallest thumbnail that is at least the requested size
+	size := 0
+	if req.Size > 0 {
+		for _, candidate := range artworkSizes {
+			if candidate >= int(req.Size) && candidate < max(artwork.Width, artwork.Height) {
+				size = candidate
+			}
+		}
+	}
+
+	object, err := s.MinioClient.GetObject(stream.Context(), s.Config.S3Bucket, artworkKey(artwork.Hash, size), minio.GetObjectOptions{})
+	if err != nil {
+		return status.Errorf(codes.NotFound, "artwork not found: %v", err)
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		return status.Errorf(codes.NotFound, "artwork not found in storage: %v", err)
+	}
+
+	err = stream.Send(&pb.GetArtworkResponse{Data: &pb.GetArtworkResponse_Header{Header: &pb.ArtworkHeader{
+		ArtworkHash: artwork.Hash,
+		ContentType: info.ContentType,
+		TotalSize:   info.Size,
+		Size:        int32(size),
+	}}})
+	if err != nil {
+		return status.Errorf(codes.Unknown, "failed to send header: %v", err)
+	}
+
+	buffer := make([]byte, 64*1024) // 64KB chunks
+	for {
+		n, err := object.Read(buffer)
+		if n > 0 {
+			if err := stream.Send(&pb.GetArtworkResponse{Data: &pb.GetArtworkResponse_Chunk{Chunk: buffer[:n]}}); err != nil {
+				return status.Errorf(codes.Unknown, "failed to send chunk: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read from S3: %v", err)
+		}
+	}
+
+	return nil
+}
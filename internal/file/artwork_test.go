@@ -0,0 +1,62 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// pngClaiming returns a small PNG whose header declares width x height
+// pixels; only the header is consistent with that.
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, data, CRC
+	ihdr := b[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	binary.BigEndian.PutUint32(b[8+8+13:], crc32.ChecksumIEEE(b[8+4:8+8+13]))
+	return b
+}
+
+func TestDecodeArtwork(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := decodeArtwork(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || img.Bounds().Dx() != 40 || img.Bounds().Dy() != 30 {
+		t.Errorf("decoded %s image of %v", format, img.Bounds())
+	}
+
+	tests := []struct {
+		name          string
+		width, height uint32
+	}{
+		{"wide", maxArtworkEdge + 1, 1},
+		{"tall", 1, maxArtworkEdge + 1},
+		{"too many pixels", 8000, 8000},
+		{"huge", 60000, 60000},
+	}
+	for _, tt := range tests {
+		_, _, err := decodeArtwork(pngClaiming(t, tt.width, tt.height))
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("%s: %dx%d image gave %v, want it rejected as too large", tt.name, tt.width, tt.height, err)
+		}
+	}
+
+	if _, _, err := decodeArtwork([]byte("not an image")); err == nil {
+		t.Error("garbage decoded")
+	}
+}
@@ -0,0 +1,56 @@
+package file
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PinBlob creates the blob row if needed and marks it as just referenced, so
+// the collector leaves the object alone while an upload is in flight.
+func PinBlob(db *gorm.DB, hash string, size int64) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"size": size, "updated_at": time.Now()}),
+	}).Create(&Blob{Hash: hash, Size: size}).Error
+}
+
+// ErrBlobNotFound is returned when referencing a blob that is not stored.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// RetainBlob records a new live reference to the blob.
+func RetainBlob(db *gorm.DB, hash string) error {
+	result := db.Model(&Blob{}).Where("hash = ?", hash).Update("ref_count", gorm.Expr("ref_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// ReleaseBlob drops a live reference to the blob. The object itself is
+// removed later by the Collector.
+func ReleaseBlob(db *gorm.DB, hash string) error {
+	return db.Model(&Blob{}).Where("hash = ? AND ref_count > 0", hash).Update("ref_count", gorm.Expr("ref_count - 1")).Error
+}
+
+// ReconcileBlobs creates blob rows for tracks stored before reference
+// counting existed and recomputes every count from the live library entries.
+func ReconcileBlobs(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Exec(`INSERT INTO blobs (hash, size, ref_count, created_at, updated_at)
+			SELECT DISTINCT hash, 0, 0, ?, ? FROM tracks
+			WHERE deleted_at IS NULL AND hash NOT IN (SELECT hash FROM blobs)`, now, now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE blobs SET ref_count = (
+			SELECT COUNT(*) FROM library_entries
+			WHERE library_entries.hash = blobs.hash AND library_entries.deleted_at IS NULL)`).Error
+	})
+}
@@ -0,0 +1,113 @@
+package file
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Change kinds
+const (
+	ChangeUpsert = "upsert"
+	ChangeDelete = "delete"
+)
+
+// RecordChange appends a change of hash to the user's change log.
+func RecordChange(db *gorm.DB, username, hash, kind string) error {
+	return db.Create(&Change{Username: username, Hash: hash, Kind: kind}).Error
+}
+
+// RecordPlaylistChange appends a change of one of the user's playlists to
+// the user's change log.
+func RecordPlaylistChange(db *gorm.DB, username, playlistID, kind string) error {
+	return db.Create(&Change{Username: username, PlaylistID: playlistID, Kind: kind}).Error
+}
+
+// RecordTrackChange appends a change of hash to the change log of every user
+// that has it in their library, for changes to the shared track itself.
+func RecordTrackChange(db *gorm.DB, hash, kind string) error {
+	return db.Exec(
+		"INSERT INTO changes (username, hash, kind, created_at) SELECT username, ?, ?, ? FROM library_entries WHERE hash = ? AND deleted_at IS NULL",
+		hash, kind, time.Now(), hash,
+	).Error
+}
+
+// LatestChange returns the ID of the newest change, the cursor of a client
+// that has seen everything. Compaction may have removed that change, which
+// is fine: IDs are never reused.
+func LatestChange(db *gorm.DB) (uint, error) {
+	var latest uint
+	if err := db.Model(&Change{}).Select("COALESCE(MAX(id), 0)").Scan(&latest).Error; err != nil {
+		return 0, err
+	}
+	compacted, err := CompactedThrough(db)
+	return max(latest, compacted), err
+}
+
+// CompactedThrough returns the highest change ID removed by compaction.
+func CompactedThrough(db *gorm.DB) (uint, error) {
+	var state ChangeLogState
+	err := db.Where("id = 1").Limit(1).Find(&state).Error
+	return state.CompactedThrough, err
+}
+
+// CompactChanges drops changes superseded by a newer change of the same
+// track or playlist, which loses nothing since clients only act on the latest
+// state, and then removes changes older than retention. The latter breaks
+// cursors pointing before them, so the highest removed ID is remembered to
+// tell those clients to resync. It returns the number of changes removed.
+func CompactChanges(db *gorm.DB, retention time.Duration) (int64, error) {
+	var removed int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM changes WHERE id NOT IN (SELECT MAX(id) FROM changes GROUP BY username, hash, playlist_id)")
+		if result.Error != nil {
+			return result.Error
+		}
+		removed = result.RowsAffected
+
+		cutoff := time.Now().Add(-retention)
+		var horizon uint
+		if err := tx.Model(&Change{}).Where("created_at < ?", cutoff).Select("COALESCE(MAX(id), 0)").Scan(&horizon).Error; err != nil {
+			return err
+		}
+		if horizon == 0 {
+			return nil
+		}
+
+		result = tx.Where("id <= ?", horizon).Delete(&Change{})
+		if result.Error != nil {
+			return result.Error
+		}
+		removed += result.RowsAffected
+
+		return tx.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{"compacted_through": gorm.Expr("MAX(compacted_through, excluded.compacted_through)")}),
+		}).Create(&ChangeLogState{ID: 1, CompactedThrough: horizon}).Error
+	})
+	return removed, err
+}
+
+// RunChangeCompactor compacts the change log every interval until ctx is
+// cancelled.
+func RunChangeCompactor(ctx context.Context, db *gorm.DB, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := CompactChanges(db, retention)
+			if err != nil {
+				log.Printf("Change log compaction failed: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("Change log compaction removed %d changes", removed)
+			}
+		}
+	}
+}
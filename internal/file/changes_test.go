@@ -0,0 +1,107 @@
+package file
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	database, err := db.Connect(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AutoMigrate(&Track{}, &LibraryEntry{}, &Blob{}, &Change{}, &ChangeLogState{}); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func changeIDs(t *testing.T, database *gorm.DB) []uint {
+	t.Helper()
+	var ids []uint
+	if err := database.Model(&Change{}).Order("id").Pluck("id", &ids).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestCompactChanges(t *testing.T) {
+	database := newTestDB(t)
+	old := time.Now().Add(-48 * time.Hour)
+	changes := []Change{
+		{Username: "alice", Hash: "a", Kind: ChangeUpsert, CreatedAt: old}, // 1, superseded by 3
+		{Username: "alice", Hash: "b", Kind: ChangeUpsert, CreatedAt: old}, // 2, expired
+		{Username: "alice", Hash: "a", Kind: ChangeDelete, CreatedAt: old}, // 3, expired
+		{Username: "bob", Hash: "a", Kind: ChangeUpsert},                   // 4, another user
+		{Username: "alice", PlaylistID: "p", Kind: ChangeUpsert},           // 5, superseded by 7
+		{Username: "alice", Hash: "c", Kind: ChangeUpsert},                 // 6
+		{Username: "alice", PlaylistID: "p", Kind: ChangeUpsert},           // 7
+		{Username: "alice", PlaylistID: "q", Kind: ChangeDelete},           // 8
+		{Username: "alice", Hash: "c", Kind: ChangeDelete},                 // 9, supersedes 6
+		{Username: "alice", Hash: "d", Kind: ChangeUpsert, CreatedAt: old}, // 10, sets the horizon
+		{Username: "alice", Hash: "e", Kind: ChangeUpsert},                 // 11
+	}
+	if err := database.Create(&changes).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := CompactChanges(database, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Superseded: 1, 5, 6. Then everything up to the newest expired change,
+	// 10, goes: 2, 3, 4, 7, 8, 9 and 10 itself
+	if removed != 10 {
+		t.Errorf("removed %d changes, want 10", removed)
+	}
+	if ids := changeIDs(t, database); len(ids) != 1 || ids[0] != 11 {
+		t.Errorf("remaining changes %v, want [11]", ids)
+	}
+	if compacted, err := CompactedThrough(database); err != nil || compacted != 10 {
+		t.Errorf("CompactedThrough = %d, %v, want 10", compacted, err)
+	}
+
+	// The horizon never moves back, and the latest change stays known after
+	// the log is emptied
+	if err := database.Where("id = 11").Delete(&Change{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompactChanges(database, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if compacted, _ := CompactedThrough(database); compacted != 10 {
+		t.Errorf("CompactedThrough = %d after an empty compaction, want 10", compacted)
+	}
+	if latest, err := LatestChange(database); err != nil || latest != 10 {
+		t.Errorf("LatestChange = %d, %v, want 10", latest, err)
+	}
+}
+
+func TestCompactChangesKeepsRecent(t *testing.T) {
+	database := newTestDB(t)
+	for _, hash := range []string{"a", "b", "a", "c"} {
+		if err := RecordChange(database, "alice", hash, ChangeUpsert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := CompactChanges(database, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d changes, want 1", removed)
+	}
+	if ids := changeIDs(t, database); len(ids) != 3 || ids[0] != 2 || ids[1] != 3 || ids[2] != 4 {
+		t.Errorf("remaining changes %v, want [2 3 4]", ids)
+	}
+	// Nothing expired, so every cursor can still be served
+	if compacted, _ := CompactedThrough(database); compacted != 0 {
+		t.Errorf("CompactedThrough = %d, want 0", compacted)
+	}
+}
@@ -0,0 +1,104 @@
+package file
+
+import (
+	"context"
+	"strings"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// maxCheckHashes bounds a single CheckHashes call; clients batch larger sets.
+const maxCheckHashes = 5000
+
+// hashQueryBatch keeps IN lists well below SQLite's variable limit.
+const hashQueryBatch = 500
+
+// heldBefore restricts a Track query to content the user has had in their
+// library, including entries deleted since. Knowing a hash proves nothing,
+// so content other users uploaded is neither revealed nor linked; it has to
+// be uploaded, which then shares the stored object.
+func heldBefore(username string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("tracks.hash IN (SELECT hash FROM library_entries WHERE username = ?)", username)
+	}
+}
+
+func (s *Server) CheckHashes(ctx context.Context, req *pb.CheckHashesRequest) (*pb.CheckHashesResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Hashes) > maxCheckHashes {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d hashes per call", maxCheckHashes)
+	}
+
+	hashes := make([]string, len(req.Hashes))
+	for i, h := range req.Hashes {
+		hashes[i] = strings.ToLower(h)
+	}
+
+	stored := make(map[string]bool)
+	inLibrary := make(map[string]bool)
+	for start := 0; start < len(hashes); start += hashQueryBatch {
+		batch := hashes[start:min(start+hashQueryBatch, len(hashes))]
+
+		var found []string
+		if err := s.DB.Model(&Track{}).Scopes(heldBefore(username)).Where("hash IN ?", batch).Pluck("hash", &found).Error; err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to look up tracks: %v", err)
+		}
+		for _, h := range found {
+			stored[h] = true
+		}
+
+		found = nil
+		if err := s.DB.Model(&LibraryEntry{}).Where("username = ? AND hash IN ?", username, batch).Pluck("hash", &found).Error; err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to look up library: %v", err)
+		}
+		for _, h := range found {
+			inLibrary[h] = true
+		}
+	}
+
+	statuses := make([]*pb.HashStatus, len(hashes))
+	for i, h := range hashes {
+		statuses[i] = &pb.HashStatus{
+			Hash:      h,
+			Stored:    stored[h],
+			InLibrary: inLibrary[h],
+		}
+	}
+
+	return &pb.CheckHashesResponse{Statuses: statuses}, nil
+}
+
+func (s *Server) LinkExisting(ctx context.Context, req *pb.LinkExistingRequest) (*pb.UploadResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Metadata == nil || req.Metadata.Sha256 == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "metadata.sha256 is required")
+	}
+	hash := strings.ToLower(req.Metadata.Sha256)
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Track{}).Scopes(heldBefore(username)).Where("hash = ?", hash).Count(&count).Error; err != nil {
+			return status.Errorf(codes.Internal, "failed to look up track: %v", err)
+		}
+		if count == 0 {
+			return status.Errorf(codes.NotFound, "content %s is not stored, upload it instead", hash)
+		}
+		return saveTrack(tx, username, hash, req.Metadata, "", "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Events.Publish(username)
+
+	return &pb.UploadResponse{Hash: hash}, nil
+}
@@ -0,0 +1,70 @@
+package file
+
+import (
+	"context"
+	"errors"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/audio"
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+// Playable restricts a track query to tracks detected as audio.
+func Playable(db *gorm.DB) *gorm.DB {
+	return db.Where("tracks.format <> ''")
+}
+
+// DetectFormats sniffs the stored content of tracks uploaded before formats
+// were recorded and returns how many were identified as audio. Objects that
+// are not audio keep an empty format and are tried again on the next run.
+func DetectFormats(ctx context.Context, db *gorm.DB, client *minio.Client, bucket string) (int, error) {
+	var tracks []Track
+	if err := db.Where("format = ''").Find(&tracks).Error; err != nil {
+		return 0, err
+	}
+
+	detected := 0
+	for _, track := range tracks {
+		format, err := detectObject(ctx, client, bucket, track.Hash)
+		if errors.Is(err, audio.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			return detected, err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&Track{}).Where("id = ?", track.ID).Updates(map[string]interface{}{
+				"format":    string(format),
+				"mime_type": format.MIMEType(),
+			}).Error
+			if err != nil {
+				return err
+			}
+			// The track becomes visible to sync
+			return RecordTrackChange(tx, track.Hash, ChangeUpsert)
+		})
+		if err != nil {
+			return detected, err
+		}
+		detected++
+	}
+	return detected, nil
+}
+
+// detectObject reads just enough of an object to identify its format.
+func detectObject(ctx context.Context, client *minio.Client, bucket, hash string) (audio.Format, error) {
+	object, err := client.GetObject(ctx, bucket, hash, minio.GetObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", audio.ErrUnsupported // Missing content is never playable
+		}
+		return "", err
+	}
+	return audio.Detect(object, info.Size)
+}
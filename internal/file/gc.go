@@ -0,0 +1,88 @@
+package file
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+// Collector removes objects from MinIO once no live library entry references
+// them and they have been unreferenced for longer than GracePeriod.
+type Collector struct {
+	DB          *gorm.DB
+	MinioClient *minio.Client
+	Bucket      string
+	Interval    time.Duration
+	GracePeriod time.Duration
+}
+
+// Run collects garbage every Interval until ctx is cancelled.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := c.Collect(ctx)
+			if err != nil {
+				log.Printf("Blob collection failed: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("Blob collection removed %d objects", removed)
+			}
+		}
+	}
+}
+
+// Collect performs a single collection pass and returns the number of
+// objects removed.
+func (c *Collector) Collect(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-c.GracePeriod)
+
+	var candidates []Blob
+	err := c.DB.Where("ref_count = 0 AND updated_at < ?", cutoff).
+		Where("hash NOT IN (?)", c.DB.Model(&LibraryEntry{}).Select("hash")).
+		Find(&candidates).Error
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, blob := range candidates {
+		deleted := false
+		// Deleting the row first takes the SQLite write lock, so a concurrent
+		// Upload pinning the same hash waits until the object is gone and then
+		// stores it again.
+		err := c.DB.Transaction(func(tx *gorm.DB) error {
+			result := tx.Where("hash = ? AND ref_count = 0 AND updated_at < ?", blob.Hash, cutoff).Delete(&Blob{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return nil // Referenced again since the scan
+			}
+			if err := tx.Where("hash = ?", blob.Hash).Delete(&Track{}).Error; err != nil {
+				return err
+			}
+			if err := c.MinioClient.RemoveObject(ctx, c.Bucket, blob.Hash, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+			deleted = true
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,72 @@
+package file
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// InLibrary restricts a Track query to tracks in the user's library.
+func InLibrary(username string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Joins("JOIN library_entries ON library_entries.hash = tracks.hash AND library_entries.deleted_at IS NULL").
+			Where("library_entries.username = ?", username)
+	}
+}
+
+// AddToLibrary adds hash to the user's library, restoring a previously
+// deleted entry if there is one, and records the change. It reports whether
+// a new live reference was created, in which case the caller must retain the
+// blob.
+func AddToLibrary(db *gorm.DB, username, hash string) (bool, error) {
+	var entry LibraryEntry
+	err := db.Unscoped().Where("username = ? AND hash = ?", username, hash).First(&entry).Error
+	if err == nil {
+		if !entry.DeletedAt.Valid {
+			return false, nil
+		}
+		if err := db.Model(&entry).Unscoped().Update("deleted_at", nil).Error; err != nil {
+			return false, err
+		}
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		if err := db.Create(&LibraryEntry{Username: username, Hash: hash}).Error; err != nil {
+			return false, err
+		}
+	} else {
+		return false, err
+	}
+	if err := RecordChange(db, username, hash, ChangeUpsert); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoveFromLibrary deletes the user's reference to hash, records a
+// tombstone and releases the blob. It reports whether the user had the track.
+func RemoveFromLibrary(db *gorm.DB, username, hash string) (bool, error) {
+	removed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("username = ? AND hash = ?", username, hash).Delete(&LibraryEntry{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		removed = true
+		if err := RecordChange(tx, username, hash, ChangeDelete); err != nil {
+			return err
+		}
+		return ReleaseBlob(tx, hash)
+	})
+	return removed, err
+}
+
+// InUserLibrary reports whether hash is in the user's library.
+func InUserLibrary(db *gorm.DB, username, hash string) (bool, error) {
+	var count int64
+	if err := db.Model(&LibraryEntry{}).Where("username = ? AND hash = ?", username, hash).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
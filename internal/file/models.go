@@ -1,6 +1,8 @@
 package file
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -12,4 +14,76 @@ type Track struct {
 	Artist   string
 	Album    string
 	Duration int32
+	// AlbumID groups tracks by artist and album for artwork lookups
+	AlbumID     string `gorm:"index"`
+	ArtworkHash string
+	// Format is detected from the content, empty if it is not audio
+	Format   string `gorm:"index"`
+	MIMEType string
+}
+
+// LibraryEntry links a user to a track. Objects in MinIO are shared by
+// content hash, so several users may reference the same Track.
+type LibraryEntry struct {
+	gorm.Model
+	Username string `gorm:"uniqueIndex:idx_library_user_hash"`
+	Hash     string `gorm:"uniqueIndex:idx_library_user_hash"`
+}
+
+// Blob is an object stored in MinIO under its content hash. RefCount is the
+// number of live library entries pointing at it; UpdatedAt doubles as the time
+// the blob was last referenced, which the collector uses as its grace period.
+type Blob struct {
+	Hash      string `gorm:"primaryKey"`
+	Size      int64
+	RefCount  int64 `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+// UploadSession is a resumable upload in progress. Received bytes live in
+// <UploadDir>/<ID>.part; the file size is the current offset.
+type UploadSession struct {
+	ID        string `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	Filename  string
+	Title     string
+	Artist    string
+	Album     string
+	Duration  int32
+	Sha256    string    // Declared content hash, optional
+	Size      int64     // Declared total size, 0 if unknown
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Artwork is a deduplicated cover image stored under artwork/<Hash>/ in
+// MinIO, along with its JPEG thumbnails.
+type Artwork struct {
+	Hash      string `gorm:"primaryKey"`
+	MIMEType  string
+	Width     int
+	Height    int
+	CreatedAt time.Time
+}
+
+// Change records that a track in a user's library, or one of the user's
+// playlists if PlaylistID is set, changed. The auto-incrementing ID doubles
+// as the sync cursor; SQLite commits writes one at a time, so IDs become
+// visible in order.
+type Change struct {
+	ID         uint   `gorm:"primaryKey;autoIncrement;index:idx_change_user_id,priority:2"`
+	Username   string `gorm:"index:idx_change_user_id,priority:1"`
+	Hash       string
+	PlaylistID string `gorm:"default:''"`
+	Kind       string
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+// ChangeLogState is a single row holding the highest change ID removed by
+// compaction. Cursors below it cannot be served incrementally.
+type ChangeLogState struct {
+	ID               uint `gorm:"primaryKey"`
+	CompactedThrough uint
 }
@@ -0,0 +1,95 @@
+package file
+
+import (
+	"context"
+	"log"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/auth"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// userTables are the tables of the Sync service in the shared database that
+// hold per-user rows, in deletion order. They are named here since this
+// package cannot import the ones defining them; tables that do not exist
+// yet are skipped.
+var userTables = []struct{ table, query string }{
+	{"playlist_items", "playlist_id IN (SELECT id FROM playlists WHERE username = ?)"},
+	{"playlists", "username = ?"},
+	{"device_tracks", "device_id IN (SELECT device_id FROM device_states WHERE username = ?)"},
+	{"device_states", "username = ?"},
+	{"sync_rules", "username = ?"},
+	{"device_sync_settings", "username = ?"},
+	{"playback_states", "username = ?"},
+	{"plays", "username = ?"},
+	{"annotations", "username = ?"},
+}
+
+func (s *Server) PurgeUser(ctx context.Context, req *pb.PurgeUserRequest) (*pb.PurgeUserResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if claims.Role != auth.RoleAdmin {
+		return nil, status.Errorf(codes.PermissionDenied, "admin role required")
+	}
+	if req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "username is required")
+	}
+
+	var sessions []UploadSession
+	if err := s.DB.Where("username = ?", req.Username).Find(&sessions).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load upload sessions: %v", err)
+	}
+	for i := range sessions {
+		s.discardSession(&sessions[i])
+	}
+
+	removed, err := PurgeUser(s.DB, req.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to purge user: %v", err)
+	}
+	log.Printf("Purged user %s with %d library entries", req.Username, removed)
+	return &pb.PurgeUserResponse{RemovedTracks: int32(removed)}, nil
+}
+
+// PurgeUser deletes the user's library, releasing its blobs, along with
+// their change log and everything the Sync service keeps for them. It
+// returns how many tracks were in the library.
+func PurgeUser(db *gorm.DB, username string) (int, error) {
+	removed := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// No tombstones are recorded: the user's devices cannot sync anymore
+		// and the change log goes too
+		var hashes []string
+		if err := tx.Model(&LibraryEntry{}).Where("username = ?", username).Pluck("hash", &hashes).Error; err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := ReleaseBlob(tx, hash); err != nil {
+				return err
+			}
+		}
+		removed = len(hashes)
+		if err := tx.Unscoped().Where("username = ?", username).Delete(&LibraryEntry{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("username = ?", username).Delete(&Change{}).Error; err != nil {
+			return err
+		}
+
+		for _, t := range userTables {
+			if !tx.Migrator().HasTable(t.table) {
+				continue
+			}
+			if err := tx.Exec("DELETE FROM "+t.table+" WHERE "+t.query, username).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,289 @@
+package file
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+func (s *Server) InitUpload(ctx context.Context, req *pb.InitUploadRequest) (*pb.InitUploadResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size := req.Size
+	if size == 0 && req.Metadata != nil {
+		size = req.Metadata.Size
+	}
+	if size < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "size must not be negative")
+	}
+	if err := s.checkSize(size); err != nil {
+		return nil, err
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate upload id: %v", err)
+	}
+
+	if err := os.MkdirAll(s.Config.UploadDir, 0o755); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create upload directory: %v", err)
+	}
+	f, err := os.Create(s.partPath(id))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create upload file: %v", err)
+	}
+	f.Close()
+
+	session := UploadSession{
+		ID:        id,
+		Username:  username,
+		Size:      size,
+		ExpiresAt: time.Now().Add(s.Config.UploadSessionTTL),
+	}
+	if md := req.Metadata; md != nil {
+		session.Filename = md.Filename
+		session.Title = md.Title
+		session.Artist = md.Artist
+		session.Album = md.Album
+		session.Duration = md.Duration
+		session.Sha256 = md.Sha256
+	}
+	if err := s.DB.Create(&session).Error; err != nil {
+		os.Remove(s.partPath(id))
+		return nil, status.Errorf(codes.Internal, "failed to save upload session: %v", err)
+	}
+
+	return &pb.InitUploadResponse{UploadId: id, ExpiresAt: session.ExpiresAt.Unix()}, nil
+}
+
+func (s *Server) UploadChunk(stream pb.FileService_UploadChunkServer) error {
+	username, err := interceptor.UsernameFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	var session *UploadSession
+	var part *os.File
+	var offset int64
+	defer func() {
+		if part != nil {
+			part.Close()
+		}
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.Unknown, "failed to receive chunk: %v", err)
+		}
+
+		if session == nil {
+			session, err = s.loadSession(username, req.UploadId)
+			if err != nil {
+				return err
+			}
+			part, err = os.OpenFile(s.partPath(session.ID), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to open upload file: %v", err)
+			}
+			info, err := part.Stat()
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to stat upload file: %v", err)
+			}
+			offset = info.Size()
+		} else if req.UploadId != session.ID {
+			return status.Errorf(codes.InvalidArgument, "all chunks in a stream must belong to one upload")
+		}
+
+		if req.Offset != offset {
+			return status.Errorf(codes.FailedPrecondition, "offset mismatch: expected %d, got %d", offset, req.Offset)
+		}
+		if session.Size > 0 && offset+int64(len(req.Chunk)) > session.Size {
+			return status.Errorf(codes.OutOfRange, "chunk exceeds declared size of %d bytes", session.Size)
+		}
+		if err := s.checkSize(offset + int64(len(req.Chunk))); err != nil {
+			return err
+		}
+
+		n, err := part.Write(req.Chunk)
+		offset += int64(n)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to write chunk: %v", err)
+		}
+	}
+
+	if session == nil {
+		return status.Errorf(codes.InvalidArgument, "no chunks received")
+	}
+
+	// Keep sessions that are still being written to alive
+	if err := s.DB.Model(session).Update("expires_at", time.Now().Add(s.Config.UploadSessionTTL)).Error; err != nil {
+		return status.Errorf(codes.Internal, "failed to extend upload session: %v", err)
+	}
+
+	return stream.SendAndClose(&pb.UploadChunkResponse{Offset: offset})
+}
+
+func (s *Server) QueryUploadOffset(ctx context.Context, req *pb.QueryUploadOffsetRequest) (*pb.QueryUploadOffsetResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.loadSession(username, req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(s.partPath(session.ID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat upload file: %v", err)
+	}
+
+	return &pb.QueryUploadOffsetResponse{Offset: info.Size(), ExpiresAt: session.ExpiresAt.Unix()}, nil
+}
+
+func (s *Server) CompleteUpload(ctx context.Context, req *pb.CompleteUploadRequest) (*pb.UploadResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.loadSession(username, req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := req.Sha256
+	if expected == "" {
+		expected = session.Sha256
+	}
+	if expected == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "sha256 is required")
+	}
+
+	part, err := os.Open(s.partPath(session.ID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to open upload file: %v", err)
+	}
+	defer part.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, part)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash upload: %v", err)
+	}
+	if session.Size > 0 && size != session.Size {
+		return nil, status.Errorf(codes.FailedPrecondition, "upload incomplete: received %d of %d bytes", size, session.Size)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(hash, expected) {
+		s.discardSession(session)
+		return nil, status.Errorf(codes.DataLoss, "sha256 mismatch: expected %s, got %s", expected, hash)
+	}
+
+	metadata := &pb.FileMetadata{
+		Filename: session.Filename,
+		Title:    session.Title,
+		Artist:   session.Artist,
+		Album:    session.Album,
+		Duration: session.Duration,
+	}
+	if err := s.store(ctx, username, part, hash, size, metadata); err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			s.discardSession(session) // Retrying cannot make it audio
+		}
+		return nil, err
+	}
+
+	s.discardSession(session)
+	return &pb.UploadResponse{Hash: hash}, nil
+}
+
+func (s *Server) loadSession(username, id string) (*UploadSession, error) {
+	var session UploadSession
+	err := s.DB.Where("id = ? AND username = ?", id, username).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && time.Now().After(session.ExpiresAt)) {
+		return nil, status.Errorf(codes.NotFound, "upload session not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load upload session: %v", err)
+	}
+	return &session, nil
+}
+
+func (s *Server) discardSession(session *UploadSession) {
+	if err := s.DB.Delete(session).Error; err != nil {
+		log.Printf("Failed to delete upload session %s: %v", session.ID, err)
+	}
+	if err := os.Remove(s.partPath(session.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove upload file %s: %v", session.ID, err)
+	}
+}
+
+func (s *Server) partPath(id string) string {
+	return filepath.Join(s.Config.UploadDir, id+".part")
+}
+
+// ExpireUploadSessions deletes sessions past their expiry together with their
+// partial data and returns how many were removed.
+func (s *Server) ExpireUploadSessions() (int, error) {
+	var expired []UploadSession
+	if err := s.DB.Where("expires_at < ?", time.Now()).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	for i := range expired {
+		s.discardSession(&expired[i])
+	}
+	return len(expired), nil
+}
+
+// RunUploadJanitor expires abandoned upload sessions every interval until ctx
+// is cancelled.
+func (s *Server) RunUploadJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := s.ExpireUploadSessions()
+			if err != nil {
+				log.Printf("Upload session expiry failed: %v", err)
+			}
+			if expired > 0 {
+				log.Printf("Expired %d abandoned upload sessions", expired)
+			}
+		}
+	}
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/datapeice/astolfosplayer-backend/internal/audio"
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
 	"github.com/minio/minio-go/v7"
 	"google.golang.org/grpc/codes"
@@ -22,9 +26,17 @@ type Server struct {
 	MinioClient *minio.Client
 	DB          *gorm.DB
 	Config      *config.FileConfig
+	// Events is notified with the username whenever a library changes. It
+	// only reaches a Sync server running in the same process and may be nil.
+	Events *pubsub.Broker
 }
 
 func (s *Server) Upload(stream pb.FileService_UploadServer) error {
+	username, err := interceptor.UsernameFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
 	tempFile, err := os.CreateTemp("", "upload-*")
 	if err != nil {
 		return status.Errorf(codes.Internal, "failed to create temp file: %v", err)
@@ -34,6 +46,7 @@ func (s *Server) Upload(stream pb.FileService_UploadServer) error {
 
 	hasher := sha256.New()
 	var metadata *pb.FileMetadata
+	var size int64
 
 	for {
 		req, err := stream.Recv()
@@ -47,31 +60,108 @@ func (s *Server) Upload(stream pb.FileService_UploadServer) error {
 		switch payload := req.Data.(type) {
 		case *pb.UploadRequest_Metadata:
 			metadata = payload.Metadata
+			if err := s.checkSize(metadata.Size); err != nil {
+				return err
+			}
 		case *pb.UploadRequest_Chunk:
+			if err := s.checkSize(size + int64(len(payload.Chunk))); err != nil {
+				return err
+			}
 			if _, err := tempFile.Write(payload.Chunk); err != nil {
 				return status.Errorf(codes.Internal, "failed to write to temp file: %v", err)
 			}
 			if _, err := hasher.Write(payload.Chunk); err != nil {
 				return status.Errorf(codes.Internal, "failed to update hash: %v", err)
 			}
+			size += int64(len(payload.Chunk))
 		}
 	}
 
 	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	// Reset temp file pointer
-	if _, err := tempFile.Seek(0, 0); err != nil {
+	// Nothing reaches MinIO unless it matches what the client sent
+	if err := verifyDeclared(metadata, hash, size); err != nil {
+		return err
+	}
+
+	if err := s.store(stream.Context(), username, tempFile, hash, size, metadata); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&pb.UploadResponse{Hash: hash})
+}
+
+// checkSize rejects uploads larger than the configured maximum.
+func (s *Server) checkSize(size int64) error {
+	if s.Config.MaxUploadSize > 0 && size > s.Config.MaxUploadSize {
+		return status.Errorf(codes.ResourceExhausted, "upload exceeds maximum size of %d bytes", s.Config.MaxUploadSize)
+	}
+	return nil
+}
+
+// verifyDeclared compares the received content with the hash and size the
+// client declared in its metadata, if any.
+func verifyDeclared(metadata *pb.FileMetadata, hash string, size int64) error {
+	if metadata == nil {
+		return nil
+	}
+	if metadata.Size > 0 && metadata.Size != size {
+		return status.Errorf(codes.DataLoss, "size mismatch: declared %d bytes, received %d", metadata.Size, size)
+	}
+	if metadata.Sha256 != "" && !strings.EqualFold(metadata.Sha256, hash) {
+		return status.Errorf(codes.DataLoss, "sha256 mismatch: declared %s, received %s", metadata.Sha256, hash)
+	}
+	return nil
+}
+
+// store puts a fully received file into MinIO under its hash and adds it to
+// the user's library. Errors are returned as gRPC status errors.
+func (s *Server) store(ctx context.Context, username string, f *os.File, hash string, size int64, metadata *pb.FileMetadata) error {
+	// Reset file pointer
+	if _, err := f.Seek(0, 0); err != nil {
 		return status.Errorf(codes.Internal, "failed to seek temp file: %v", err)
 	}
 
+	format, err := audio.Detect(f, size)
+	if err != nil {
+		if errors.Is(err, audio.ErrUnsupported) {
+			return status.Errorf(codes.InvalidArgument, "not a supported audio file")
+		}
+		return status.Errorf(codes.Internal, "failed to inspect upload: %v", err)
+	}
+
+	metadata, picture := s.applyTags(f, size, metadata)
+	artworkHash := s.storeArtwork(ctx, picture)
+
+	// Keep the collector away from this hash while we store it
+	if err := PinBlob(s.DB, hash, size); err != nil {
+		return status.Errorf(codes.Internal, "failed to pin blob: %v", err)
+	}
+
 	// Upload to MinIO
-	_, err = s.MinioClient.PutObject(context.Background(), s.Config.S3Bucket, hash, tempFile, -1, minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
+	_, err = s.MinioClient.PutObject(ctx, s.Config.S3Bucket, hash, f, size, minio.PutObjectOptions{
+		ContentType: format.MIMEType(),
 	})
 	if err != nil {
 		return status.Errorf(codes.Internal, "failed to upload to S3: %v", err)
 	}
 
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		return saveTrack(tx, username, hash, metadata, format, artworkHash)
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(username)
+	return nil
+}
+
+// saveTrack upserts the track metadata for a stored blob and adds it to the
+// user's library. An empty format or artworkHash keeps the existing value.
+// The Track is shared by everyone owning the content, so empty metadata
+// fields never clear it, and while other users own it their tags are only
+// completed, never replaced.
+func saveTrack(tx *gorm.DB, username, hash string, metadata *pb.FileMetadata, format audio.Format, artworkHash string) error {
 	// Save metadata
 	track := Track{
 		Hash: hash,
@@ -83,61 +173,164 @@ func (s *Server) Upload(stream pb.FileService_UploadServer) error {
 		track.Album = metadata.Album
 		track.Duration = metadata.Duration
 	}
+	track.AlbumID = AlbumID(track.Artist, track.Album)
+	track.ArtworkHash = artworkHash
+	if format != "" {
+		track.Format = string(format)
+		track.MIMEType = format.MIMEType()
+	}
 
 	// Upsert metadata
 	var existingTrack Track
 	// Use Unscoped to find even soft-deleted records
-	result := s.DB.Unscoped().Where("hash = ?", hash).First(&existingTrack)
+	result := tx.Unscoped().Where("hash = ?", hash).First(&existingTrack)
 	if result.Error == nil {
-		// Update existing and restore if deleted
-		updates := map[string]interface{}{
-			"filename":   track.Filename,
-			"title":      track.Title,
-			"artist":     track.Artist,
-			"album":      track.Album,
-			"duration":   track.Duration,
-			"deleted_at": nil, // Restore if deleted
-		}
-		if err := s.DB.Model(&existingTrack).Unscoped().Updates(updates).Error; err != nil {
-			return status.Errorf(codes.Internal, "failed to update metadata: %v", err)
+		var others int64
+		err := tx.Model(&LibraryEntry{}).Where("hash = ? AND username <> ?", hash, username).Count(&others).Error
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to check owners: %v", err)
+		}
+		shared := others > 0
+
+		updates := map[string]interface{}{}
+		set := func(column, current, value string) {
+			if value != "" && value != current && (!shared || current == "") {
+				updates[column] = value
+			}
+		}
+		set("filename", existingTrack.Filename, track.Filename)
+		set("title", existingTrack.Title, track.Title)
+		set("artist", existingTrack.Artist, track.Artist)
+		set("album", existingTrack.Album, track.Album)
+		if track.Duration != 0 && track.Duration != existingTrack.Duration && (!shared || existingTrack.Duration == 0) {
+			updates["duration"] = track.Duration
+		}
+		artist, album := existingTrack.Artist, existingTrack.Album
+		if v, ok := updates["artist"]; ok {
+			artist = v.(string)
+		}
+		if v, ok := updates["album"]; ok {
+			album = v.(string)
+		}
+		if albumID := AlbumID(artist, album); albumID != existingTrack.AlbumID {
+			updates["album_id"] = albumID
+		}
+		if artworkHash != "" && artworkHash != existingTrack.ArtworkHash {
+			updates["artwork_hash"] = artworkHash
+		}
+		if format != "" && track.Format != existingTrack.Format {
+			updates["format"] = track.Format
+			updates["mime_type"] = track.MIMEType
+		}
+		if existingTrack.DeletedAt.Valid {
+			updates["deleted_at"] = nil // Restore if deleted
+		}
+
+		if len(updates) > 0 {
+			if err := tx.Model(&existingTrack).Unscoped().Updates(updates).Error; err != nil {
+				return status.Errorf(codes.Internal, "failed to update metadata: %v", err)
+			}
+			// Everyone sharing the track sees the new metadata
+			if err := RecordTrackChange(tx, hash, ChangeUpsert); err != nil {
+				return status.Errorf(codes.Internal, "failed to record change: %v", err)
+			}
 		}
 	} else if result.Error == gorm.ErrRecordNotFound {
 		// Create new
-		if err := s.DB.Create(&track).Error; err != nil {
+		if err := tx.Create(&track).Error; err != nil {
 			return status.Errorf(codes.Internal, "failed to save metadata: %v", err)
 		}
 	} else {
 		return status.Errorf(codes.Internal, "failed to check existing metadata: %v", result.Error)
 	}
 
-	return stream.SendAndClose(&pb.UploadResponse{Hash: hash})
+	added, err := AddToLibrary(tx, username, hash)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to add track to library: %v", err)
+	}
+	if added {
+		if err := RetainBlob(tx, hash); err != nil {
+			if errors.Is(err, ErrBlobNotFound) {
+				return status.Errorf(codes.NotFound, "blob %s not found", hash)
+			}
+			return status.Errorf(codes.Internal, "failed to retain blob: %v", err)
+		}
+	}
+	return nil
 }
 
 func (s *Server) Download(req *pb.DownloadRequest, stream pb.FileService_DownloadServer) error {
-	fmt.Printf("Download request for hash: %s\n", req.Hash)
-	object, err := s.MinioClient.GetObject(context.Background(), s.Config.S3Bucket, req.Hash, minio.GetObjectOptions{})
+	username, err := interceptor.UsernameFromContext(stream.Context())
 	if err != nil {
-		return status.Errorf(codes.NotFound, "file not found: %v", err)
+		return err
+	}
+
+	owned, err := InUserLibrary(s.DB, username, req.Hash)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check library: %v", err)
+	}
+	if !owned {
+		return status.Errorf(codes.NotFound, "file not found")
+	}
+
+	if req.Offset < 0 || req.Length < 0 {
+		return status.Errorf(codes.InvalidArgument, "offset and length must not be negative")
 	}
-	defer object.Close()
 
 	// Check if object exists
-	_, err = object.Stat()
+	info, err := s.MinioClient.StatObject(stream.Context(), s.Config.S3Bucket, req.Hash, minio.StatObjectOptions{})
 	if err != nil {
 		errResponse := minio.ToErrorResponse(err)
 		if errResponse.Code == "NoSuchKey" {
 			log.Printf("File %s missing in MinIO, removing from DB", req.Hash)
+			if err := RecordTrackChange(s.DB, req.Hash, ChangeDelete); err != nil {
+				log.Printf("Failed to record removal of %s: %v", req.Hash, err)
+			}
 			s.DB.Where("hash = ?", req.Hash).Delete(&Track{})
+			s.DB.Where("hash = ?", req.Hash).Delete(&LibraryEntry{})
+			s.DB.Where("hash = ?", req.Hash).Delete(&Blob{})
 			return status.Errorf(codes.NotFound, "file not found in storage")
 		}
 		return status.Errorf(codes.Internal, "failed to stat file: %v", err)
 	}
 
+	if req.Offset > info.Size || (req.Offset == info.Size && info.Size > 0) {
+		return status.Errorf(codes.OutOfRange, "offset %d is beyond the end of the file (%d bytes)", req.Offset, info.Size)
+	}
+	length := info.Size - req.Offset
+	if req.Length > 0 && req.Length < length {
+		length = req.Length
+	}
+
+	err = stream.Send(&pb.DownloadResponse{Data: &pb.DownloadResponse_Header{Header: &pb.DownloadHeader{
+		Hash:        req.Hash,
+		TotalSize:   info.Size,
+		ContentType: info.ContentType,
+		Offset:      req.Offset,
+		Length:      length,
+	}}})
+	if err != nil {
+		return status.Errorf(codes.Unknown, "failed to send header: %v", err)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(req.Offset, req.Offset+length-1); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid range: %v", err)
+	}
+	object, err := s.MinioClient.GetObject(stream.Context(), s.Config.S3Bucket, req.Hash, opts)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+	defer object.Close()
+
 	buffer := make([]byte, 64*1024) // 64KB chunks
 	for {
 		n, err := object.Read(buffer)
 		if n > 0 {
-			if err := stream.Send(&pb.DownloadResponse{Chunk: buffer[:n]}); err != nil {
+			if err := stream.Send(&pb.DownloadResponse{Data: &pb.DownloadResponse_Chunk{Chunk: buffer[:n]}}); err != nil {
 				return status.Errorf(codes.Unknown, "failed to send chunk: %v", err)
 			}
 		}
@@ -153,25 +346,21 @@ func (s *Server) Download(req *pb.DownloadRequest, stream pb.FileService_Downloa
 }
 
 func (s *Server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	// Delete from MinIO
-	err := s.MinioClient.RemoveObject(context.Background(), s.Config.S3Bucket, req.Hash, minio.RemoveObjectOptions{})
+	username, err := interceptor.UsernameFromContext(ctx)
 	if err != nil {
-		return &pb.DeleteResponse{Success: false}, status.Errorf(codes.Internal, "failed to delete from S3: %v", err)
+		return nil, err
 	}
 
-	// Delete from DB
-	result := s.DB.Where("hash = ?", req.Hash).Delete(&Track{})
-	if result.Error != nil {
-		return &pb.DeleteResponse{Success: false}, status.Errorf(codes.Internal, "failed to delete metadata: %v", result.Error)
+	// Remove only the caller's reference; the object is shared by content hash
+	// and removed by the Collector once nobody references it
+	removed, err := RemoveFromLibrary(s.DB, username, req.Hash)
+	if err != nil {
+		return &pb.DeleteResponse{Success: false}, status.Errorf(codes.Internal, "failed to delete library entry: %v", err)
 	}
-
-	if result.RowsAffected == 0 {
-		// Even if not in DB, if deleted from S3 (or didn't exist), we might consider it success?
-		// But user asked for status.
-		// If MinIO delete didn't error, it's "success" even if file didn't exist (MinIO behavior).
-		// But if DB didn't have it, maybe it wasn't there.
-		// Let's return true if no error occurred.
+	if !removed {
+		return &pb.DeleteResponse{Success: false}, status.Errorf(codes.NotFound, "file not found")
 	}
+	s.Events.Publish(username)
 
 	return &pb.DeleteResponse{Success: true}, nil
 }
@@ -0,0 +1,60 @@
+package file
+
+import (
+	"log"
+	"math"
+	"os"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/audio"
+	"github.com/datapeice/astolfosplayer-backend/internal/config"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/file"
+)
+
+// Client and file durations further apart than this are logged as suspicious.
+const durationTolerance = 2
+
+// applyTags merges the tags embedded in f with the client-sent metadata and
+// returns the embedded cover art, if any. With TagPrecedenceClient the tags
+// only fill empty fields; with TagPrecedenceFile they replace whatever the
+// client sent. Unreadable files are not an error, the client metadata is kept
+// as is.
+func (s *Server) applyTags(f *os.File, size int64, metadata *pb.FileMetadata) (*pb.FileMetadata, *audio.Picture) {
+	merged := &pb.FileMetadata{}
+	if metadata != nil {
+		merged.Filename = metadata.Filename
+		merged.Title = metadata.Title
+		merged.Artist = metadata.Artist
+		merged.Album = metadata.Album
+		merged.Duration = metadata.Duration
+		merged.Sha256 = metadata.Sha256
+		merged.Size = metadata.Size
+	}
+
+	tags, err := audio.ReadTags(f, size)
+	if err != nil {
+		log.Printf("Could not read tags from %q: %v", merged.Filename, err)
+		return merged, nil
+	}
+
+	fileWins := s.Config.TagPrecedence == config.TagPrecedenceFile
+	merge := func(field *string, value string) {
+		if value != "" && (fileWins || *field == "") {
+			*field = value
+		}
+	}
+	merge(&merged.Title, tags.Title)
+	merge(&merged.Artist, tags.Artist)
+	merge(&merged.Album, tags.Album)
+
+	duration := int32(math.Round(tags.Duration.Seconds()))
+	if duration > 0 {
+		if merged.Duration > 0 && math.Abs(float64(merged.Duration-duration)) > durationTolerance {
+			log.Printf("Duration mismatch for %q: client sent %ds, stream is %ds", merged.Filename, merged.Duration, duration)
+		}
+		if fileWins || merged.Duration == 0 {
+			merged.Duration = duration
+		}
+	}
+
+	return merged, tags.Picture
+}
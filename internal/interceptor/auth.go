@@ -0,0 +1,134 @@
+package interceptor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthInterceptor validates the "authorization: Bearer <token>" metadata on
+// incoming calls and stores the token claims in the request context.
+type AuthInterceptor struct {
+	verifier      auth.Verifier
+	publicMethods map[string]bool
+	denylist      *auth.Denylist
+	// guestMethods are the only methods guests may call, nil for no
+	// restriction
+	guestMethods map[string]bool
+}
+
+// NewAuthInterceptor returns an interceptor verifying tokens with verifier.
+// Full method names listed in publicMethods skip authentication.
+func NewAuthInterceptor(verifier auth.Verifier, publicMethods ...string) *AuthInterceptor {
+	public := make(map[string]bool, len(publicMethods))
+	for _, m := range publicMethods {
+		public[m] = true
+	}
+	return &AuthInterceptor{
+		verifier:      verifier,
+		publicMethods: public,
+	}
+}
+
+// WithDenylist makes the interceptor reject tokens on the denylist.
+func (a *AuthInterceptor) WithDenylist(denylist *auth.Denylist) *AuthInterceptor {
+	a.denylist = denylist
+	return a
+}
+
+// WithGuestMethods lists the full method names users with the read-only
+// guest role may call; every other method is denied to them, so methods
+// added later stay closed to guests until listed.
+func (a *AuthInterceptor) WithGuestMethods(methods ...string) *AuthInterceptor {
+	a.guestMethods = make(map[string]bool, len(methods))
+	for _, m := range methods {
+		a.guestMethods[m] = true
+	}
+	return a
+}
+
+func (a *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if a.publicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if a.publicMethods[info.FullMethod] {
+			return handler(srv, ss)
+		}
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func (a *AuthInterceptor) authenticate(ctx context.Context, method string) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "missing metadata")
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "missing authorization header")
+	}
+
+	token, found := strings.CutPrefix(values[0], "Bearer ")
+	if !found || token == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "authorization header must use the Bearer scheme")
+	}
+
+	claims, err := auth.ValidateToken(token, a.verifier)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if a.denylist != nil && a.denylist.Revoked(claims.ID) {
+		return nil, status.Errorf(codes.Unauthenticated, "token has been revoked")
+	}
+	if claims.Role == auth.RoleGuest && a.guestMethods != nil && !a.guestMethods[method] {
+		return nil, status.Errorf(codes.PermissionDenied, "guests have read-only access")
+	}
+
+	return auth.NewContext(ctx, claims), nil
+}
+
+// authenticatedStream overrides the stream context so handlers see the claims.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// ClaimsFromContext returns the claims stored by the interceptor.
+func ClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	return auth.FromContext(ctx)
+}
+
+// UsernameFromContext returns the authenticated username, or an
+// Unauthenticated status error if the call was not authenticated.
+func UsernameFromContext(ctx context.Context) (string, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	return claims.Username, nil
+}
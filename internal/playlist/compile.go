@@ -0,0 +1,165 @@
+package playlist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"gorm.io/gorm"
+)
+
+// sqliteTime is how times are passed to SQLite's date functions.
+const sqliteTime = "2006-01-02 15:04:05"
+
+// defaultOrder sorts smart playlists without ORDER BY like an album list.
+var defaultOrder = []orderTerm{
+	{field: queryFields["artist"]},
+	{field: queryFields["album"]},
+	{field: queryFields["title"]},
+}
+
+// tracks returns the query selecting the user's tracks that match q, in
+// order. Times relative to now are resolved against now.
+func (q *Query) tracks(db *gorm.DB, username string, now time.Time) *gorm.DB {
+	used := make(map[*queryField]bool)
+	q.walk(q.Where, func(c *comparison) { used[c.field] = true })
+	for _, o := range q.Order {
+		used[o.field] = true
+	}
+
+	tx := db.Model(&file.Track{}).Scopes(file.InLibrary(username), file.Playable)
+	if used[queryFields["size"]] {
+		tx = tx.Joins("LEFT JOIN blobs ON blobs.hash = tracks.hash")
+	}
+	if used[queryFields["play_count"]] || used[queryFields["last_played"]] {
+		tx = tx.Joins("LEFT JOIN (SELECT track_hash, COUNT(*) AS play_count, MAX(started_at) AS last_played "+
+			"FROM plays WHERE username = ? GROUP BY track_hash) AS stats ON stats.track_hash = tracks.hash", username)
+	}
+	for field := range used {
+		if field.annotation {
+			tx = tx.Joins("LEFT JOIN annotations ON annotations.hash = tracks.hash AND annotations.username = ?", username)
+			break
+		}
+	}
+
+	if q.Where != nil {
+		var sql strings.Builder
+		var args []interface{}
+		compileExpr(&sql, &args, q.Where, now)
+		tx = tx.Where(sql.String(), args...)
+	}
+
+	order := q.Order
+	if len(order) == 0 {
+		order = defaultOrder
+	}
+	for _, o := range order {
+		column := o.field.column
+		if o.field.kind == kindText {
+			column += " COLLATE NOCASE"
+		}
+		if o.desc {
+			column += " DESC"
+		}
+		tx = tx.Order(column)
+	}
+	tx = tx.Order("tracks.id")
+
+	limit := maxPlaylistItems
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+	return tx.Limit(limit)
+}
+
+func (q *Query) walk(e expr, fn func(*comparison)) {
+	switch e := e.(type) {
+	case *logicalExpr:
+		q.walk(e.left, fn)
+		q.walk(e.right, fn)
+	case *notExpr:
+		q.walk(e.x, fn)
+	case *comparison:
+		fn(e)
+	}
+}
+
+func compileExpr(sql *strings.Builder, args *[]interface{}, e expr, now time.Time) {
+	switch e := e.(type) {
+	case *logicalExpr:
+		// Chains of the same operator are written flat, the parser nests them
+		// one level per condition and SQLite's parser stack is shallow
+		sql.WriteString("(")
+		for i, operand := range operands(e, e.op, nil) {
+			if i > 0 {
+				sql.WriteString(" " + e.op + " ")
+			}
+			compileExpr(sql, args, operand, now)
+		}
+		sql.WriteString(")")
+	case *notExpr:
+		sql.WriteString("NOT ")
+		compileExpr(sql, args, e.x, now)
+	case *comparison:
+		compileComparison(sql, args, e, now)
+	}
+}
+
+// operands appends the operands of the chain of op expressions rooted at e
+// to list, in order.
+func operands(e expr, op string, list []expr) []expr {
+	if l, ok := e.(*logicalExpr); ok && l.op == op {
+		return operands(l.right, op, operands(l.left, op, list))
+	}
+	return append(list, e)
+}
+
+func compileComparison(sql *strings.Builder, args *[]interface{}, c *comparison, now time.Time) {
+	column := c.field.column
+	switch c.field.kind {
+	case kindText:
+		if c.op == "CONTAINS" {
+			fmt.Fprintf(sql, "INSTR(LOWER(%s), LOWER(?)) > 0", column)
+		} else {
+			fmt.Fprintf(sql, "LOWER(%s) %s LOWER(?)", column, c.op)
+		}
+		*args = append(*args, c.value)
+
+	case kindTag:
+		match := "LOWER(json_each.value) = LOWER(?)"
+		if c.op == "CONTAINS" {
+			match = "INSTR(LOWER(json_each.value), LOWER(?)) > 0"
+		}
+		if c.op == "!=" {
+			sql.WriteString("NOT ")
+		}
+		fmt.Fprintf(sql, "EXISTS (SELECT 1 FROM json_each(NULLIF(%s, '')) WHERE %s)", column, match)
+		*args = append(*args, c.value)
+
+	case kindTime:
+		var t time.Time
+		switch v := c.value.(type) {
+		case time.Time:
+			t = v
+		case time.Duration:
+			t = now.Add(-v)
+		}
+		// Days compare by calendar date, everything else by instant
+		compare := fmt.Sprintf("julianday(%s) %s julianday(?)", column, c.op)
+		if c.op == "=" || c.op == "!=" {
+			compare = fmt.Sprintf("date(%s) %s date(?)", column, c.op)
+		}
+		// Keep the result true or false so NOT stays correct for missing times
+		if c.field.nullIsOldest && (c.op == "<" || c.op == "<=" || c.op == "!=") {
+			fmt.Fprintf(sql, "(%s IS NULL OR %s)", column, compare)
+		} else {
+			fmt.Fprintf(sql, "(%s IS NOT NULL AND %s)", column, compare)
+		}
+		*args = append(*args, t.UTC().Format(sqliteTime))
+
+	default:
+		fmt.Fprintf(sql, "%s %s ?", column, c.op)
+		*args = append(*args, c.value)
+	}
+}
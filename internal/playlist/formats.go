@@ -0,0 +1,371 @@
+package playlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Format is a playlist file format.
+type Format string
+
+// Supported playlist file formats
+const (
+	FormatM3U  Format = "m3u" // Also M3U8
+	FormatPLS  Format = "pls"
+	FormatXSPF Format = "xspf"
+)
+
+// ErrUnknownFormat is returned for content that is not a playlist file.
+var ErrUnknownFormat = errors.New("unknown playlist format")
+
+// ContentType returns the MIME type of files in the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatPLS:
+		return "audio/x-scpls"
+	case FormatXSPF:
+		return "application/xspf+xml"
+	}
+	return "audio/x-mpegurl"
+}
+
+// Extension returns the file extension used for exports, without the dot.
+func (f Format) Extension() string {
+	if f == FormatM3U {
+		return "m3u8"
+	}
+	return string(f)
+}
+
+// FormatFromExtension returns the format of a playlist file name.
+func FormatFromExtension(name string) (Format, bool) {
+	ext := strings.ToLower(name)
+	if i := strings.LastIndexByte(ext, '.'); i >= 0 {
+		ext = ext[i+1:]
+	}
+	switch ext {
+	case "m3u", "m3u8":
+		return FormatM3U, true
+	case "pls":
+		return FormatPLS, true
+	case "xspf":
+		return FormatXSPF, true
+	}
+	return "", false
+}
+
+// Entry is a track reference in a playlist file.
+type Entry struct {
+	Location string // Path or URL as written in the file
+	Title    string
+	Artist   string
+	Album    string
+	Duration int32 // Seconds, 0 if unknown
+}
+
+// DetectFormat guesses the format of a playlist file from its content.
+func DetectFormat(data []byte) Format {
+	head := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	switch {
+	case bytes.HasPrefix(head, []byte("<")):
+		return FormatXSPF
+	case len(head) >= 10 && strings.EqualFold(string(head[:10]), "[playlist]"):
+		return FormatPLS
+	}
+	return FormatM3U
+}
+
+// Parse reads a playlist file and returns its title, if it has one, and its
+// entries in order.
+func Parse(format Format, data []byte) (string, []Entry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch format {
+	case FormatM3U:
+		// Plain .m3u files from older players are Latin-1
+		if !utf8.Valid(data) {
+			data = latin1ToUTF8(data)
+		}
+		return parseM3U(data)
+	case FormatPLS:
+		return parsePLS(data)
+	case FormatXSPF:
+		return parseXSPF(data)
+	}
+	return "", nil, ErrUnknownFormat
+}
+
+func parseM3U(data []byte) (string, []Entry, error) {
+	var name string
+	var entries []Entry
+	var pending Entry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<seconds> [attributes],<artist> - <title>
+			info := line[len("#EXTINF:"):]
+			display := ""
+			if i := strings.IndexByte(info, ','); i >= 0 {
+				info, display = info[:i], info[i+1:]
+			}
+			if fields := strings.Fields(info); len(fields) > 0 {
+				pending.Duration = parseSeconds(fields[0])
+			}
+			pending.Artist, pending.Title = splitDisplayTitle(display)
+		case strings.HasPrefix(line, "#EXTALB:"):
+			pending.Album = strings.TrimSpace(line[len("#EXTALB:"):])
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			name = strings.TrimSpace(line[len("#PLAYLIST:"):])
+		case strings.HasPrefix(line, "#"):
+		default:
+			pending.Location = line
+			entries = append(entries, pending)
+			pending = Entry{}
+		}
+	}
+	// Lines beyond the buffer stop the scan, which must not silently cut the
+	// playlist short
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	return name, entries, nil
+}
+
+func parsePLS(data []byte) (string, []Entry, error) {
+	byIndex := make(map[int]*Entry)
+	var name string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "x-name" || key == "playlistname" {
+			name = value
+			continue
+		}
+
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, f) {
+				field = f
+				break
+			}
+		}
+		if field == "" {
+			continue
+		}
+		index, err := strconv.Atoi(key[len(field):])
+		if err != nil {
+			continue
+		}
+		entry := byIndex[index]
+		if entry == nil {
+			entry = &Entry{}
+			byIndex[index] = entry
+		}
+		switch field {
+		case "file":
+			entry.Location = value
+		case "title":
+			entry.Artist, entry.Title = splitDisplayTitle(value)
+		case "length":
+			entry.Duration = parseSeconds(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+
+	indexes := make([]int, 0, len(byIndex))
+	for i, entry := range byIndex {
+		if entry.Location != "" {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	entries := make([]Entry, len(indexes))
+	for i, index := range indexes {
+		entries[i] = *byIndex[index]
+	}
+	return name, entries, nil
+}
+
+// xspfPlaylist is the subset of XSPF we read and write. The namespace is
+// not enforced on import since some players leave it out.
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location []string `xml:"location"`
+	Title    string   `xml:"title,omitempty"`
+	Creator  string   `xml:"creator,omitempty"`
+	Album    string   `xml:"album,omitempty"`
+	Duration int64    `xml:"duration,omitempty"` // Milliseconds
+}
+
+func parseXSPF(data []byte) (string, []Entry, error) {
+	var doc xspfPlaylist
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	if err := decoder.Decode(&doc); err != nil {
+		return "", nil, fmt.Errorf("invalid XSPF: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(doc.Tracks))
+	for _, t := range doc.Tracks {
+		entry := Entry{
+			Title:    strings.TrimSpace(t.Title),
+			Artist:   strings.TrimSpace(t.Creator),
+			Album:    strings.TrimSpace(t.Album),
+			Duration: int32(t.Duration / 1000),
+		}
+		if len(t.Location) > 0 {
+			entry.Location = strings.TrimSpace(t.Location[0])
+		}
+		entries = append(entries, entry)
+	}
+	return strings.TrimSpace(doc.Title), entries, nil
+}
+
+// Write writes a playlist file with the given title and entries.
+func Write(w io.Writer, format Format, name string, entries []Entry) error {
+	switch format {
+	case FormatM3U:
+		return writeM3U(w, name, entries)
+	case FormatPLS:
+		return writePLS(w, name, entries)
+	case FormatXSPF:
+		return writeXSPF(w, name, entries)
+	}
+	return ErrUnknownFormat
+}
+
+func writeM3U(w io.Writer, name string, entries []Entry) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#EXTM3U\n#PLAYLIST:%s\n", oneLine(name))
+	for _, e := range entries {
+		duration := int32(-1)
+		if e.Duration > 0 {
+			duration = e.Duration
+		}
+		fmt.Fprintf(b, "#EXTINF:%d,%s\n", duration, oneLine(displayTitle(e)))
+		if e.Album != "" {
+			fmt.Fprintf(b, "#EXTALB:%s\n", oneLine(e.Album))
+		}
+		fmt.Fprintf(b, "%s\n", oneLine(e.Location))
+	}
+	return b.Flush()
+}
+
+func writePLS(w io.Writer, name string, entries []Entry) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "[playlist]\nX-Name=%s\n", oneLine(name))
+	for i, e := range entries {
+		duration := int32(-1)
+		if e.Duration > 0 {
+			duration = e.Duration
+		}
+		fmt.Fprintf(b, "File%d=%s\nTitle%d=%s\nLength%d=%d\n",
+			i+1, oneLine(e.Location), i+1, oneLine(displayTitle(e)), i+1, duration)
+	}
+	fmt.Fprintf(b, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+	return b.Flush()
+}
+
+func writeXSPF(w io.Writer, name string, entries []Entry) error {
+	doc := xspfPlaylist{Xmlns: "http://xspf.org/ns/0/", Version: "1", Title: name}
+	for _, e := range entries {
+		doc.Tracks = append(doc.Tracks, xspfTrack{
+			Location: []string{locationURI(e.Location)},
+			Title:    e.Title,
+			Creator:  e.Artist,
+			Album:    e.Album,
+			Duration: int64(e.Duration) * 1000,
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// locationURI turns a plain filename into the relative URI XSPF requires,
+// leaving URLs alone.
+func locationURI(location string) string {
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" {
+		return location
+	}
+	return (&url.URL{Path: location}).String()
+}
+
+// displayTitle is the "Artist - Title" line M3U and PLS use.
+func displayTitle(e Entry) string {
+	switch {
+	case e.Artist == "":
+		return e.Title
+	case e.Title == "":
+		return e.Artist
+	}
+	return e.Artist + " - " + e.Title
+}
+
+// splitDisplayTitle splits an "Artist - Title" line. Lines without the
+// separator are taken as the title.
+func splitDisplayTitle(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if artist, title, ok := strings.Cut(s, " - "); ok {
+		return strings.TrimSpace(artist), strings.TrimSpace(title)
+	}
+	return "", s
+}
+
+// parseSeconds parses a duration in seconds; players write -1 or fractions
+// for unknown and sub-second lengths.
+func parseSeconds(s string) int32 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f <= 0 || f > 1<<30 {
+		return 0
+	}
+	return int32(f + 0.5)
+}
+
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func latin1ToUTF8(b []byte) []byte {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return []byte(string(runes))
+}
@@ -0,0 +1,162 @@
+package playlist
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseM3U(t *testing.T) {
+	data := "\xef\xbb\xbf#EXTM3U\r\n" +
+		"#PLAYLIST: Road trip \r\n" +
+		"#EXTINF:215 tvg-id=\"x\",Daft Punk - One More Time\r\n" +
+		"#EXTALB:Discovery\r\n" +
+		"Music/Daft Punk/01 One More Time.mp3\r\n" +
+		"\r\n" +
+		"# a comment\r\n" +
+		"#EXTINF:-1,Untitled\r\n" +
+		"http://example.com/stream.mp3\r\n" +
+		"C:\\Music\\plain.flac\r\n"
+	name, entries, err := Parse(FormatM3U, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Road trip" {
+		t.Errorf("name = %q", name)
+	}
+	want := []Entry{
+		{Location: "Music/Daft Punk/01 One More Time.mp3", Title: "One More Time", Artist: "Daft Punk", Album: "Discovery", Duration: 215},
+		{Location: "http://example.com/stream.mp3", Title: "Untitled"},
+		{Location: `C:\Music\plain.flac`},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", entries, want)
+	}
+}
+
+func TestParseM3ULatin1(t *testing.T) {
+	_, entries, err := Parse(FormatM3U, []byte("#EXTINF:10,Bj\xf6rk - J\xf3ga\nj\xf3ga.mp3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Artist != "Björk" || entries[0].Location != "jóga.mp3" {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestParseM3ULongLine(t *testing.T) {
+	data := "first.mp3\n" + strings.Repeat("x", 2<<20) + "\nlast.mp3\n"
+	if _, _, err := Parse(FormatM3U, []byte(data)); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("err = %v, want %v", err, bufio.ErrTooLong)
+	}
+}
+
+func TestParsePLS(t *testing.T) {
+	data := "[playlist]\n" +
+		"X-Name=Mix\n" +
+		"File2=b.mp3\n" +
+		"Title2=Only Title\n" +
+		"File1=a.ogg\n" +
+		"Title1=Artist - Song\n" +
+		"Length1=180.4\n" +
+		"Length2=-1\n" +
+		"Title3=No file\n" +
+		"NumberOfEntries=3\n" +
+		"Version=2\n"
+	name, entries, err := Parse(FormatPLS, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Mix" {
+		t.Errorf("name = %q", name)
+	}
+	want := []Entry{
+		{Location: "a.ogg", Title: "Song", Artist: "Artist", Duration: 180},
+		{Location: "b.mp3", Title: "Only Title"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", entries, want)
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1">
+  <title> Evening </title>
+  <trackList>
+    <track>
+      <location>file:///music/a.mp3</location>
+      <location>http://mirror/a.mp3</location>
+      <title>Song</title>
+      <creator>Artist</creator>
+      <album>Album</album>
+      <duration>183500</duration>
+    </track>
+    <track><title>Nothing else</title></track>
+  </trackList>
+</playlist>`
+	name, entries, err := Parse(FormatXSPF, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Evening" {
+		t.Errorf("name = %q", name)
+	}
+	want := []Entry{
+		{Location: "file:///music/a.mp3", Title: "Song", Artist: "Artist", Album: "Album", Duration: 183},
+		{Title: "Nothing else"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", entries, want)
+	}
+
+	if _, _, err := Parse(FormatXSPF, []byte("<playlist><trackList>")); err == nil {
+		t.Error("truncated XSPF parsed without error")
+	}
+}
+
+func TestWriteParseRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Location: "Music/a b.mp3", Title: "Song", Artist: "Artist", Album: "Album", Duration: 200},
+		{Location: "http://example.com/x.ogg", Title: "Line\nbreak"},
+		{Location: "c.flac", Artist: "Only Artist"},
+	}
+	for _, format := range []Format{FormatM3U, FormatPLS, FormatXSPF} {
+		var buf bytes.Buffer
+		if err := Write(&buf, format, "My list", entries); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got := DetectFormat(buf.Bytes()); got != format {
+			t.Errorf("%s: detected as %s", format, got)
+		}
+		name, got, err := Parse(format, buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if name != "My list" || len(got) != len(entries) {
+			t.Fatalf("%s: parsed %q with %d entries", format, name, len(got))
+		}
+
+		// M3U and PLS carry the artist in the display title and no album
+		// in PLS; XSPF escapes the location into a URI
+		want := []Entry{
+			{Location: "Music/a b.mp3", Title: "Song", Artist: "Artist", Album: "Album", Duration: 200},
+			{Location: "http://example.com/x.ogg", Title: "Line break"},
+			{Location: "c.flac", Title: "Only Artist"},
+		}
+		switch format {
+		case FormatPLS:
+			want[0].Album = ""
+		case FormatXSPF:
+			want[0].Location = "Music/a%20b.mp3"
+			want[1].Title = "Line\nbreak"
+			want[2] = Entry{Location: "c.flac", Artist: "Only Artist"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: entries = %+v\nwant %+v", format, got, want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package playlist
+
+import (
+	"errors"
+	"time"
+
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/playlist"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// resolvedItem is a playlist item with the current metadata of its track.
+type resolvedItem struct {
+	Item
+	Filename  string
+	Title     string
+	Artist    string
+	Album     string
+	Duration  int32
+	InLibrary bool
+}
+
+// Load returns the user's playlist with its items resolved against the
+// current track metadata. Errors are returned as gRPC status errors.
+func Load(db *gorm.DB, username, playlistID string) (*pb.Playlist, error) {
+	playlist, err := find(db, username, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := resolve(db, playlist, time.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playlist items: %v", err)
+	}
+
+	resp := playlistInfo(playlist)
+	resp.ItemCount = int32(len(items))
+	for _, r := range items {
+		resp.Items = append(resp.Items, &pb.PlaylistItem{
+			ItemId:    r.ID,
+			Hash:      r.Hash,
+			Position:  r.Position,
+			Title:     r.Title,
+			Artist:    r.Artist,
+			Album:     r.Album,
+			Duration:  r.Duration,
+			InLibrary: r.InLibrary,
+		})
+	}
+	return resp, nil
+}
+
+// Hashes returns the content hashes in the user's playlist, or none if the
+// playlist does not exist.
+func Hashes(db *gorm.DB, username, playlistID string) ([]string, error) {
+	playlist, err := find(db, username, playlistID)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items, err := resolve(db, playlist, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(items))
+	for i, item := range items {
+		hashes[i] = item.Hash
+	}
+	return hashes, nil
+}
+
+// find returns the user's playlist. Errors are returned as gRPC status
+// errors.
+func find(db *gorm.DB, username, playlistID string) (*Playlist, error) {
+	var playlist Playlist
+	err := db.Where("id = ? AND username = ?", playlistID, username).First(&playlist).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Errorf(codes.NotFound, "playlist not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playlist: %v", err)
+	}
+	return &playlist, nil
+}
+
+// resolve returns the items of a playlist in order. Smart playlists are
+// evaluated as of now; their items are addressed by track hash.
+func resolve(db *gorm.DB, playlist *Playlist, now time.Time) ([]resolvedItem, error) {
+	if playlist.Query != "" {
+		q, err := ParseQuery(playlist.Query)
+		if err != nil {
+			return nil, err
+		}
+		var items []resolvedItem
+		err = q.tracks(db, playlist.Username, now).
+			Select("tracks.hash, tracks.filename, tracks.title, tracks.artist, tracks.album, tracks.duration").
+			Scan(&items).Error
+		if err != nil {
+			return nil, err
+		}
+		for i, position := range spacedKeys(len(items)) {
+			items[i].ID = items[i].Hash
+			items[i].PlaylistID = playlist.ID
+			items[i].Position = position
+			items[i].InLibrary = true
+		}
+		return items, nil
+	}
+
+	// Tracks are matched by content hash, so metadata edits show up here and
+	// tracks collected by the blob GC still resolve to their last metadata
+	var items []resolvedItem
+	err := db.Model(&Item{}).
+		Select("playlist_items.*, tracks.filename, tracks.title, tracks.artist, tracks.album, tracks.duration, "+
+			"EXISTS (SELECT 1 FROM library_entries WHERE library_entries.hash = playlist_items.hash AND library_entries.username = ? AND library_entries.deleted_at IS NULL) AS in_library", playlist.Username).
+		Joins("LEFT JOIN tracks ON tracks.hash = playlist_items.hash").
+		Where("playlist_items.playlist_id = ?", playlist.ID).
+		Order("playlist_items.position, playlist_items.id").Scan(&items).Error
+	return items, err
+}
+
+// playlistInfo returns a playlist without its items.
+func playlistInfo(playlist *Playlist) *pb.Playlist {
+	return &pb.Playlist{
+		PlaylistId: playlist.ID,
+		Name:       playlist.Name,
+		UpdatedAt:  timestamppb.New(playlist.UpdatedAt),
+		Query:      playlist.Query,
+	}
+}
@@ -0,0 +1,277 @@
+package playlist
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"gorm.io/gorm"
+)
+
+// How entries were matched to library tracks
+const (
+	MatchNone = iota
+	MatchFilename
+	MatchTags
+)
+
+// Fuzzy matching thresholds; similarities are between 0 and 1
+const (
+	minTitleSimilarity  = 0.85
+	minArtistSimilarity = 0.75
+	// Durations further apart are different recordings
+	maxDurationDelta = 5
+	// The fallback compares an entry with at most this many tracks, those
+	// sharing the most word prefixes with it
+	maxFuzzyCandidates = 200
+	wordPrefixLength   = 3
+)
+
+// Match is the library track an entry resolved to.
+type Match struct {
+	Hash string
+	By   int
+}
+
+// candidate is a library track prepared for matching.
+type candidate struct {
+	hash     string
+	filename string
+	title    string
+	artist   string
+	duration int32
+}
+
+// MatchEntries resolves playlist file entries to tracks in the user's
+// library: by filename first, then by similar title and artist with a
+// close duration. Unmatched entries get an empty Match.
+func MatchEntries(db *gorm.DB, username string, entries []Entry) ([]Match, error) {
+	var tracks []file.Track
+	err := db.Scopes(file.InLibrary(username), file.Playable).Order("tracks.id").Find(&tracks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byFilename := make(map[string][]*candidate)
+	byTitle := make(map[string][]*candidate)
+	byPrefix := make(map[string][]*candidate)
+	for _, t := range tracks {
+		c := &candidate{
+			hash:     t.Hash,
+			filename: strings.ToLower(baseName(t.Filename)),
+			title:    normalize(t.Title),
+			artist:   normalize(t.Artist),
+			duration: t.Duration,
+		}
+		if c.title == "" {
+			c.artist, c.title = titleFromFilename(t.Filename)
+		}
+		if c.filename != "" {
+			byFilename[c.filename] = append(byFilename[c.filename], c)
+		}
+		byTitle[c.title] = append(byTitle[c.title], c)
+		for _, p := range wordPrefixes(c.title, c.artist) {
+			byPrefix[p] = append(byPrefix[p], c)
+		}
+	}
+
+	matches := make([]Match, len(entries))
+	for i, e := range entries {
+		wanted := candidate{
+			filename: strings.ToLower(baseName(e.Location)),
+			title:    normalize(e.Title),
+			artist:   normalize(e.Artist),
+			duration: e.Duration,
+		}
+		if wanted.title == "" {
+			wanted.artist, wanted.title = titleFromFilename(e.Location)
+		}
+
+		// Several uploads can share a filename; the tags pick between them
+		if same := byFilename[wanted.filename]; wanted.filename != "" && len(same) > 0 {
+			best, _ := bestMatch(&wanted, same, false)
+			if best == nil {
+				best = same[0]
+			}
+			matches[i] = Match{Hash: best.hash, By: MatchFilename}
+			continue
+		}
+		if wanted.title == "" {
+			continue
+		}
+		best, _ := bestMatch(&wanted, byTitle[wanted.title], true)
+		if best == nil {
+			best, _ = bestMatch(&wanted, fuzzyCandidates(&wanted, byPrefix), true)
+		}
+		if best != nil {
+			matches[i] = Match{Hash: best.hash, By: MatchTags}
+		}
+	}
+	return matches, nil
+}
+
+// fuzzyCandidates returns the tracks sharing the most word prefixes with
+// wanted, at most maxFuzzyCandidates of them, so the edit distance is not
+// computed against the whole library for every entry.
+func fuzzyCandidates(wanted *candidate, byPrefix map[string][]*candidate) []*candidate {
+	shared := make(map[*candidate]int)
+	for _, p := range wordPrefixes(wanted.title, wanted.artist) {
+		for _, c := range byPrefix[p] {
+			shared[c]++
+		}
+	}
+	candidates := make([]*candidate, 0, len(shared))
+	for c := range shared {
+		candidates = append(candidates, c)
+	}
+	// Sorted either way so ties resolve the same on every import
+	sort.Slice(candidates, func(i, j int) bool {
+		if shared[candidates[i]] != shared[candidates[j]] {
+			return shared[candidates[i]] > shared[candidates[j]]
+		}
+		return candidates[i].hash < candidates[j].hash
+	})
+	return candidates[:min(len(candidates), maxFuzzyCandidates)]
+}
+
+// wordPrefixes returns the distinct leading runes of the words in the
+// normalized strings.
+func wordPrefixes(normalized ...string) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, s := range normalized {
+		for _, word := range strings.Fields(s) {
+			r := []rune(word)
+			p := string(r[:min(len(r), wordPrefixLength)])
+			if !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes
+}
+
+// bestMatch returns the candidate most similar to wanted. With strict set
+// candidates below the similarity thresholds are rejected.
+func bestMatch(wanted *candidate, candidates []*candidate, strict bool) (*candidate, float64) {
+	var best *candidate
+	bestScore := 0.0
+	for _, c := range candidates {
+		if wanted.duration > 0 && c.duration > 0 {
+			if delta := wanted.duration - c.duration; delta > maxDurationDelta || delta < -maxDurationDelta {
+				continue
+			}
+		}
+		// The edit distance is at least the length difference, skip early
+		if strict && !similarLength(wanted.title, c.title, minTitleSimilarity) {
+			continue
+		}
+		title := similarity(wanted.title, c.title)
+		if strict && title < minTitleSimilarity {
+			continue
+		}
+		score := title
+		if wanted.artist != "" && c.artist != "" {
+			artist := similarity(wanted.artist, c.artist)
+			if strict && artist < minArtistSimilarity {
+				continue
+			}
+			score = (2*title + artist) / 3
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best, bestScore
+}
+
+// baseName returns the file name of a path or URL, whichever separators
+// the player that wrote it used.
+func baseName(location string) string {
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		location = u.Path
+	} else if unescaped, err := url.PathUnescape(location); err == nil && strings.Contains(location, "%") {
+		location = unescaped
+	}
+	location = strings.ReplaceAll(location, "\\", "/")
+	name := path.Base(location)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// titleFromFilename guesses artist and title from a name like
+// "01 - Artist - Title.mp3", both normalized.
+func titleFromFilename(location string) (string, string) {
+	name := baseName(location)
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	parts := strings.Split(name, " - ")
+	if len(parts) > 1 && strings.TrimLeft(parts[0], "0123456789 .") == "" {
+		parts = parts[1:]
+	}
+	if len(parts) == 1 {
+		return "", normalize(strings.TrimLeft(parts[0], "0123456789 .-_"))
+	}
+	return normalize(parts[0]), normalize(strings.Join(parts[1:], " - "))
+}
+
+// normalize lowercases s and reduces it to words, dropping punctuation and
+// bracketed suffixes like "(Remastered 2011)".
+func normalize(s string) string {
+	if i := strings.IndexAny(s, "(["); i > 0 {
+		s = s[:i]
+	}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+func similarLength(a, b string, min float64) bool {
+	la, lb := len([]rune(a)), len([]rune(b))
+	longest := max(la, lb)
+	if longest == 0 {
+		return true
+	}
+	return 1-float64(max(la-lb, lb-la))/float64(longest) >= min
+}
+
+// similarity is one minus the edit distance relative to the longer string.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diagonal+cost)
+			diagonal, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
@@ -0,0 +1,41 @@
+package playlist
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Playlist is a user's named list of tracks. Deleting a playlist
+// soft-deletes it.
+type Playlist struct {
+	ID       string `gorm:"primaryKey"`
+	Username string `gorm:"index"`
+	Name     string
+	// Query makes this a smart playlist whose tracks are computed on
+	// request instead of stored as items
+	Query string
+	// Membership fingerprints the last computed tracks of a smart playlist
+	// so refreshes can tell when they changed; MemberCount is their number
+	Membership  string
+	MemberCount int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+// Item is a track in a playlist. Items are ordered by Position, a fractional
+// key (see keyBetween), with ID breaking ties between keys generated
+// concurrently for the same gap.
+type Item struct {
+	ID         string `gorm:"primaryKey"`
+	PlaylistID string `gorm:"index"`
+	Hash       string `gorm:"index"`
+	Position   string
+	CreatedAt  time.Time
+}
+
+// TableName keeps the table name unambiguous in the shared database.
+func (Item) TableName() string {
+	return "playlist_items"
+}
@@ -0,0 +1,115 @@
+package playlist
+
+import (
+	"math/big"
+	"strings"
+)
+
+// maxKeyLength is the key length beyond which a playlist is respaced;
+// repeatedly inserting at the same spot makes keys grow by about a digit
+// every six inserts.
+const maxKeyLength = 24
+
+// Digits of the ordering keys, in ASCII order so keys compare as strings.
+const keyDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// keyBetween returns a key sorting strictly between a and b, where an empty
+// a means the start and an empty b the end of the list. Keys never end in
+// the lowest digit, so there is always room before any key.
+func keyBetween(a, b string) string {
+	if b != "" {
+		// Keep the common prefix, treating a as padded with the lowest digit
+		n := 0
+		for n < len(b) && digitAt(a, n) == strings.IndexByte(keyDigits, b[n]) {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + keyBetween(suffix(a, n), b[n:])
+		}
+	}
+
+	lo := digitAt(a, 0)
+	hi := len(keyDigits)
+	if b != "" {
+		hi = strings.IndexByte(keyDigits, b[0])
+	}
+	if hi-lo > 1 {
+		return string(keyDigits[(lo+hi)/2])
+	}
+	// Adjacent digits: a longer b can be cut short, otherwise extend a
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(keyDigits[lo]) + keyBetween(suffix(a, 1), "")
+}
+
+func digitAt(key string, i int) int {
+	if i >= len(key) {
+		return 0
+	}
+	return strings.IndexByte(keyDigits, key[i])
+}
+
+func suffix(key string, n int) string {
+	if n >= len(key) {
+		return ""
+	}
+	return key[n:]
+}
+
+// spacedKeys returns n ascending keys spread evenly over the key space.
+func spacedKeys(n int) []string {
+	return keysBetween("", "", n)
+}
+
+// keysBetween returns n ascending keys strictly between a and b, spread
+// evenly over the gap, with the same conventions as keyBetween. Inserting
+// many items at once this way keeps their keys short, where chaining
+// keyBetween would make them grow with every item.
+func keysBetween(a, b string, n int) []string {
+	base := big.NewInt(int64(len(keyDigits)))
+	for width := max(len(a), len(b), 1); ; width++ {
+		lo := keyValue(a, width)
+		hi := new(big.Int).Exp(base, big.NewInt(int64(width)), nil)
+		if b != "" {
+			hi = keyValue(b, width)
+		}
+		gap := new(big.Int).Sub(hi, lo)
+		if gap.Cmp(big.NewInt(int64(n))) <= 0 {
+			continue // Not enough room at this width, add a digit
+		}
+
+		step := gap.Div(gap, big.NewInt(int64(n+1)))
+		keys := make([]string, n)
+		v := new(big.Int).Set(lo)
+		for i := range keys {
+			v.Add(v, step)
+			keys[i] = keyString(v, width)
+		}
+		return keys
+	}
+}
+
+// keyValue reads key as a width-digit number, padding it with the lowest
+// digit; keys never end in it, so padding does not change their order.
+func keyValue(key string, width int) *big.Int {
+	base := big.NewInt(int64(len(keyDigits)))
+	v := new(big.Int)
+	for i := 0; i < width; i++ {
+		v.Mul(v, base)
+		v.Add(v, big.NewInt(int64(digitAt(key, i))))
+	}
+	return v
+}
+
+// keyString is the inverse of keyValue, dropping the padding again.
+func keyString(v *big.Int, width int) string {
+	base := big.NewInt(int64(len(keyDigits)))
+	digits := make([]byte, width)
+	rest, digit := new(big.Int).Set(v), new(big.Int)
+	for j := width - 1; j >= 0; j-- {
+		rest.DivMod(rest, base, digit)
+		digits[j] = keyDigits[digit.Int64()]
+	}
+	return strings.TrimRight(string(digits), keyDigits[:1])
+}
@@ -0,0 +1,106 @@
+package playlist
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyBetween(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"", ""},
+		{"", "V"},
+		{"V", ""},
+		{"A", "B"},
+		{"A", "A1"},
+		{"A1", "B"},
+		{"", "1"},
+		{"", "01"},
+		{"z", ""},
+		{"zz", ""},
+		{"V", "V01"},
+		{"Vz", "W"},
+	}
+	for _, tt := range tests {
+		k := keyBetween(tt.a, tt.b)
+		if k <= tt.a || (tt.b != "" && k >= tt.b) {
+			t.Errorf("keyBetween(%q, %q) = %q, not strictly between", tt.a, tt.b, k)
+		}
+		if strings.HasSuffix(k, keyDigits[:1]) {
+			t.Errorf("keyBetween(%q, %q) = %q ends in the lowest digit", tt.a, tt.b, k)
+		}
+	}
+}
+
+func TestKeyBetweenRepeatedInserts(t *testing.T) {
+	// Inserting at the front and after the first item over and over must
+	// keep producing ordered keys
+	first := keyBetween("", "")
+	for i := 0; i < 200; i++ {
+		k := keyBetween("", first)
+		if k >= first {
+			t.Fatalf("insert %d: %q not before %q", i, k, first)
+		}
+		first = k
+	}
+
+	a := keyBetween("", "")
+	b := keyBetween(a, "")
+	for i := 0; i < 200; i++ {
+		k := keyBetween(a, b)
+		if k <= a || k >= b {
+			t.Fatalf("insert %d: %q not between %q and %q", i, k, a, b)
+		}
+		a = k
+	}
+}
+
+func TestKeysBetween(t *testing.T) {
+	tests := []struct {
+		a, b string
+		n    int
+	}{
+		{"", "", 1},
+		{"", "", 10},
+		{"", "", 1000},
+		{"A", "B", 1},
+		{"A", "B", 100},
+		{"A", "A1", 5},
+		{"V", "", 62},
+		{"", "1", 3},
+		{"zzz", "", 10},
+	}
+	for _, tt := range tests {
+		keys := keysBetween(tt.a, tt.b, tt.n)
+		if len(keys) != tt.n {
+			t.Errorf("keysBetween(%q, %q, %d) returned %d keys", tt.a, tt.b, tt.n, len(keys))
+			continue
+		}
+		prev := tt.a
+		for i, k := range keys {
+			if k <= prev {
+				t.Errorf("keysBetween(%q, %q, %d)[%d] = %q, not after %q", tt.a, tt.b, tt.n, i, k, prev)
+			}
+			if strings.HasSuffix(k, keyDigits[:1]) {
+				t.Errorf("keysBetween(%q, %q, %d)[%d] = %q ends in the lowest digit", tt.a, tt.b, tt.n, i, k)
+			}
+			prev = k
+		}
+		if tt.b != "" && prev >= tt.b {
+			t.Errorf("keysBetween(%q, %q, %d) last key %q not before %q", tt.a, tt.b, tt.n, prev, tt.b)
+		}
+	}
+}
+
+func TestKeysBetweenStayShort(t *testing.T) {
+	// 62 digits per position: a thousand keys fit in two
+	for _, k := range spacedKeys(1000) {
+		if len(k) > 2 {
+			t.Fatalf("spacedKeys(1000) produced %q", k)
+		}
+	}
+	for _, k := range keysBetween("A", "B", 50) {
+		if len(k) > 2 {
+			t.Fatalf("keysBetween(A, B, 50) produced %q", k)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package playlist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Smart playlist queries select tracks from the owner's library:
+//
+//	artist = "X" AND duration > 5m AND last_played < -30d ORDER BY play_count DESC LIMIT 50
+//
+// Conditions compare a field with a value and combine with AND, OR, NOT and
+// parentheses. Text fields support =, != and CONTAINS, ignoring case, and
+// so does tag, which matches any of the track's tags; starred is true or
+// false and supports = and !=; the other fields support =, !=, <, <=, > and
+// >=. Durations take an s, m or h suffix, sizes KB, MB or GB. Times are a
+// date (2024-01-31) or a time ago like -12h, -30d, -2w or -1y. Tracks never
+// played or starred count as played or starred infinitely long ago.
+
+// Limits keeping the compiled SQL within what SQLite parses: its parser
+// stack overflows at about 25 levels of mixed AND and OR nesting
+const (
+	maxQueryDepth       = 16 // Nested parentheses and NOTs
+	maxQueryComparisons = 200
+)
+
+// fieldKind is the type of values a field holds.
+type fieldKind int
+
+const (
+	kindText fieldKind = iota
+	kindNumber
+	kindDuration // Seconds
+	kindSize     // Bytes
+	kindTime
+	kindBool
+	kindTag // Matches any element of a JSON array of strings
+)
+
+// queryField is a field queries can refer to.
+type queryField struct {
+	name   string
+	kind   fieldKind
+	column string
+	// stats is set for fields computed from the user's plays
+	stats bool
+	// annotation is set for fields from the user's track annotations
+	annotation bool
+	// nullIsOldest is set for times that may be missing, which then compare
+	// as earlier than any time
+	nullIsOldest bool
+}
+
+var queryFields = map[string]*queryField{
+	"title":       {name: "title", kind: kindText, column: "tracks.title"},
+	"artist":      {name: "artist", kind: kindText, column: "tracks.artist"},
+	"album":       {name: "album", kind: kindText, column: "tracks.album"},
+	"filename":    {name: "filename", kind: kindText, column: "tracks.filename"},
+	"format":      {name: "format", kind: kindText, column: "tracks.format"},
+	"duration":    {name: "duration", kind: kindDuration, column: "tracks.duration"},
+	"size":        {name: "size", kind: kindSize, column: "COALESCE(blobs.size, 0)"},
+	"added":       {name: "added", kind: kindTime, column: "library_entries.created_at"},
+	"play_count":  {name: "play_count", kind: kindNumber, column: "COALESCE(stats.play_count, 0)", stats: true},
+	"last_played": {name: "last_played", kind: kindTime, column: "stats.last_played", stats: true, nullIsOldest: true},
+	"starred":     {name: "starred", kind: kindBool, column: "(annotations.starred_at IS NOT NULL)", annotation: true},
+	"starred_at":  {name: "starred_at", kind: kindTime, column: "annotations.starred_at", annotation: true, nullIsOldest: true},
+	"rating":      {name: "rating", kind: kindNumber, column: "COALESCE(annotations.rating, 0)", annotation: true},
+	"skip_count":  {name: "skip_count", kind: kindNumber, column: "COALESCE(annotations.skip_count, 0)", annotation: true},
+	"tag":         {name: "tag", kind: kindTag, column: "annotations.tags", annotation: true},
+}
+
+// Query is a parsed smart playlist query.
+type Query struct {
+	Where expr // nil matches every track
+	Order []orderTerm
+	Limit int // 0 for no limit
+}
+
+type orderTerm struct {
+	field *queryField
+	desc  bool
+}
+
+// expr is a condition: *logicalExpr, *notExpr or *comparison.
+type expr interface{}
+
+type logicalExpr struct {
+	op          string // AND or OR
+	left, right expr
+}
+
+type notExpr struct {
+	x expr
+}
+
+type comparison struct {
+	field *queryField
+	op    string // =, !=, <, <=, >, >= or CONTAINS
+	// string for text and tags, int64 for numbers, durations and sizes, bool
+	// for booleans, time.Time for dates and time.Duration for times relative
+	// to now
+	value interface{}
+}
+
+// QueryError reports an invalid query.
+type QueryError struct {
+	Column int // 1-based, 0 for the end of the query
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	if e.Column == 0 {
+		return "at end of query: " + e.Msg
+	}
+	return fmt.Sprintf("at column %d: %s", e.Column, e.Msg)
+}
+
+const (
+	tokEOF = iota
+	tokWord
+	tokString
+	tokNumber // Digits with an optional sign, fraction, unit or date part
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int // Byte offset in the query
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			kind := map[byte]int{'(': tokLParen, ')': tokRParen, ',': tokComma}[c]
+			tokens = append(tokens, token{kind, string(c), i})
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, &QueryError{i + 1, "unterminated string"}
+			}
+			tokens = append(tokens, token{tokString, b.String(), i})
+			i = j + 1
+		case strings.ContainsRune("=!<>", rune(c)):
+			j := i + 1
+			if j < len(s) && (s[j] == '=' || (c == '<' && s[j] == '>')) {
+				j++
+			}
+			op := s[i:j]
+			if op == "!" {
+				return nil, &QueryError{i + 1, "unexpected !"}
+			}
+			if op == "<>" {
+				op = "!="
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i = j
+		case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (isWordByte(s[j]) || s[j] == '.' || s[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, s[i:j], i})
+			i = j
+		case isWordByte(c):
+			j := i
+			for j < len(s) && isWordByte(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, s[i:j], i})
+			i = j
+		default:
+			return nil, &QueryError{i + 1, fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(s)}), nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c < 0x80 && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)))
+}
+
+type parser struct {
+	tokens      []token
+	next        int
+	depth       int
+	comparisons int
+}
+
+// ParseQuery parses and validates a smart playlist query.
+func ParseQuery(s string) (*Query, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q := &Query{}
+
+	if !p.peekKeyword("ORDER") && !p.peekKeyword("LIMIT") && p.peek().kind != tokEOF {
+		if q.Where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("ORDER") {
+		if !p.acceptKeyword("BY") {
+			return nil, p.errorf("expected BY after ORDER")
+		}
+		for {
+			field, err := p.parseField()
+			if err != nil {
+				return nil, err
+			}
+			if field.kind == kindTag {
+				p.next--
+				return nil, p.errorf("cannot order by %s", field.name)
+			}
+			term := orderTerm{field: field}
+			if p.acceptKeyword("DESC") {
+				term.desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			q.Order = append(q.Order, term)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next++
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n <= 0 || n > maxPlaylistItems {
+			return nil, p.errorf("LIMIT must be a number between 1 and %d", maxPlaylistItems)
+		}
+		p.next++
+		q.Limit = n
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return q, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.peekKeyword(keyword) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	column := t.pos + 1
+	if t.kind == tokEOF {
+		column = 0
+	}
+	return &QueryError{column, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{"OR", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{"AND", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.peekKeyword("NOT") || p.peek().kind == tokLParen {
+		if p.depth++; p.depth > maxQueryDepth {
+			return nil, p.errorf("query is nested more than %d levels deep", maxQueryDepth)
+		}
+		defer func() { p.depth-- }()
+	}
+	if p.acceptKeyword("NOT") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, p.errorf("expected )")
+		}
+		p.next++
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseField() (*queryField, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return nil, p.errorf("expected a field name")
+	}
+	field, ok := queryFields[strings.ToLower(t.text)]
+	if !ok {
+		return nil, p.errorf("unknown field %q", t.text)
+	}
+	p.next++
+	return field, nil
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	if p.comparisons++; p.comparisons > maxQueryComparisons {
+		return nil, p.errorf("query has more than %d conditions", maxQueryComparisons)
+	}
+	field, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	var op string
+	switch {
+	case t.kind == tokOp:
+		op = t.text
+	case t.kind == tokWord && strings.EqualFold(t.text, "CONTAINS"):
+		op = "CONTAINS"
+	default:
+		return nil, p.errorf("expected an operator after %s", field.name)
+	}
+	textual := field.kind == kindText || field.kind == kindTag
+	if textual && op != "=" && op != "!=" && op != "CONTAINS" {
+		return nil, p.errorf("%s only supports =, != and CONTAINS", field.name)
+	}
+	if field.kind == kindBool && op != "=" && op != "!=" {
+		return nil, p.errorf("%s only supports = and !=", field.name)
+	}
+	if !textual && op == "CONTAINS" {
+		return nil, p.errorf("CONTAINS only works on text fields")
+	}
+	p.next++
+
+	value, err := p.parseValue(field)
+	if err != nil {
+		return nil, err
+	}
+	return &comparison{field, op, value}, nil
+}
+
+var (
+	durationUnits = map[string]int64{"": 1, "s": 1, "m": 60, "h": 3600}
+	sizeUnits     = map[string]int64{"": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}
+	timeAgoUnits  = map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+)
+
+func (p *parser) parseValue(field *queryField) (interface{}, error) {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return nil, p.errorf("expected a value for %s", field.name)
+	}
+
+	switch field.kind {
+	case kindText, kindTag:
+		if t.kind != tokString {
+			return nil, p.errorf("%s needs a quoted string", field.name)
+		}
+		p.next++
+		return t.text, nil
+
+	case kindBool:
+		if t.kind != tokWord || (!strings.EqualFold(t.text, "true") && !strings.EqualFold(t.text, "false")) {
+			return nil, p.errorf("%s needs true or false", field.name)
+		}
+		p.next++
+		return strings.EqualFold(t.text, "true"), nil
+
+	case kindNumber, kindDuration, kindSize:
+		units := map[string]int64{"": 1}
+		if field.kind == kindDuration {
+			units = durationUnits
+		} else if field.kind == kindSize {
+			units = sizeUnits
+		}
+		digits := strings.TrimRightFunc(t.text, unicode.IsLetter)
+		n, err := strconv.ParseFloat(digits, 64)
+		unit, ok := units[strings.ToLower(t.text[len(digits):])]
+		if t.kind != tokNumber || err != nil || !ok {
+			return nil, p.errorf("invalid value %q for %s", t.text, field.name)
+		}
+		p.next++
+		return int64(n * float64(unit)), nil
+
+	case kindTime:
+		if t.kind != tokNumber {
+			return nil, p.errorf("%s needs a date like 2024-01-31 or a time ago like -30d", field.name)
+		}
+		if date, err := time.Parse("2006-01-02", t.text); err == nil {
+			p.next++
+			return date, nil
+		}
+		if strings.HasPrefix(t.text, "-") && len(t.text) > 2 {
+			n, err := strconv.Atoi(t.text[1 : len(t.text)-1])
+			unit, ok := timeAgoUnits[strings.ToLower(t.text[len(t.text)-1:])]
+			if err == nil && ok && n >= 0 && n < 1000*365 {
+				p.next++
+				return time.Duration(n) * unit, nil
+			}
+		}
+		return nil, p.errorf("invalid time %q for %s, use a date like 2024-01-31 or a time ago like -30d", t.text, field.name)
+	}
+	return nil, p.errorf("unsupported field %s", field.name)
+}
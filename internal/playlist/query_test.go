@@ -0,0 +1,271 @@
+package playlist
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/db"
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func compileWhere(t *testing.T, query string, now time.Time) (string, []interface{}) {
+	t.Helper()
+	q, err := ParseQuery(query)
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", query, err)
+	}
+	if q.Where == nil {
+		return "", nil
+	}
+	var sql strings.Builder
+	var args []interface{}
+	compileExpr(&sql, &args, q.Where, now)
+	return sql.String(), args
+}
+
+func TestCompileQuery(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query string
+		sql   string
+		args  []interface{}
+	}{
+		{
+			`artist = "Daft Punk"`,
+			"LOWER(tracks.artist) = LOWER(?)",
+			[]interface{}{"Daft Punk"},
+		},
+		{
+			`title CONTAINS 'it\'s'`,
+			"INSTR(LOWER(tracks.title), LOWER(?)) > 0",
+			[]interface{}{"it's"},
+		},
+		{
+			`album <> "X"`,
+			"LOWER(tracks.album) != LOWER(?)",
+			[]interface{}{"X"},
+		},
+		{
+			`duration > 5m AND size <= 1.5MB`,
+			"(tracks.duration > ? AND COALESCE(blobs.size, 0) <= ?)",
+			[]interface{}{int64(300), int64(1572864)},
+		},
+		{
+			`play_count >= 3 OR rating = 5 AND NOT starred = true`,
+			"(COALESCE(stats.play_count, 0) >= ? OR (COALESCE(annotations.rating, 0) = ? AND NOT (annotations.starred_at IS NOT NULL) = ?))",
+			[]interface{}{int64(3), int64(5), true},
+		},
+		{
+			`(artist = "a" OR artist = "b") AND duration < 90`,
+			"((LOWER(tracks.artist) = LOWER(?) OR LOWER(tracks.artist) = LOWER(?)) AND tracks.duration < ?)",
+			[]interface{}{"a", "b", int64(90)},
+		},
+		{
+			`last_played < -30d`,
+			"(stats.last_played IS NULL OR julianday(stats.last_played) < julianday(?))",
+			[]interface{}{"2024-05-16 12:00:00"},
+		},
+		{
+			`last_played > -2w`,
+			"(stats.last_played IS NOT NULL AND julianday(stats.last_played) > julianday(?))",
+			[]interface{}{"2024-06-01 12:00:00"},
+		},
+		{
+			`added = 2024-01-31`,
+			"(library_entries.created_at IS NOT NULL AND date(library_entries.created_at) = date(?))",
+			[]interface{}{"2024-01-31 00:00:00"},
+		},
+		{
+			`tag = "chill"`,
+			"EXISTS (SELECT 1 FROM json_each(NULLIF(annotations.tags, '')) WHERE LOWER(json_each.value) = LOWER(?))",
+			[]interface{}{"chill"},
+		},
+		{
+			`tag != "chill"`,
+			"NOT EXISTS (SELECT 1 FROM json_each(NULLIF(annotations.tags, '')) WHERE LOWER(json_each.value) = LOWER(?))",
+			[]interface{}{"chill"},
+		},
+		{
+			`tag CONTAINS "rock"`,
+			"EXISTS (SELECT 1 FROM json_each(NULLIF(annotations.tags, '')) WHERE INSTR(LOWER(json_each.value), LOWER(?)) > 0)",
+			[]interface{}{"rock"},
+		},
+	}
+	for _, tt := range tests {
+		sql, args := compileWhere(t, tt.query, now)
+		if sql != tt.sql {
+			t.Errorf("%s\n got SQL %s\nwant SQL %s", tt.query, sql, tt.sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s\n got args %#v\nwant args %#v", tt.query, args, tt.args)
+		}
+	}
+}
+
+func TestParseQueryOrderAndLimit(t *testing.T) {
+	q, err := ParseQuery(`order by play_count desc, Title limit 50`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Where != nil {
+		t.Errorf("Where = %#v, want nil", q.Where)
+	}
+	if len(q.Order) != 2 || q.Order[0].field.name != "play_count" || !q.Order[0].desc ||
+		q.Order[1].field.name != "title" || q.Order[1].desc {
+		t.Errorf("Order = %+v", q.Order)
+	}
+	if q.Limit != 50 {
+		t.Errorf("Limit = %d, want 50", q.Limit)
+	}
+
+	q, err = ParseQuery("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Where != nil || q.Order != nil || q.Limit != 0 {
+		t.Errorf("empty query parsed as %+v", q)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query  string
+		column int
+		msg    string
+	}{
+		{`artist = "open`, 10, "unterminated string"},
+		{`artist ! "x"`, 8, "unexpected !"},
+		{`artist = "x" ; drop`, 14, "unexpected character ';'"},
+		{`genre = "x"`, 1, `unknown field "genre"`},
+		{`artist > "x"`, 8, "artist only supports =, != and CONTAINS"},
+		{`starred < true`, 9, "starred only supports = and !="},
+		{`duration CONTAINS 5`, 10, "CONTAINS only works on text fields"},
+		{`artist = x`, 10, "artist needs a quoted string"},
+		{`starred = yes`, 11, "starred needs true or false"},
+		{`duration > 5d`, 12, `invalid value "5d" for duration`},
+		{`size > 1TB`, 8, `invalid value "1TB" for size`},
+		{`added > yesterday`, 9, "added needs a date like 2024-01-31 or a time ago like -30d"},
+		{`added > -3x`, 9, `invalid time "-3x" for added, use a date like 2024-01-31 or a time ago like -30d`},
+		{`artist =`, 0, "expected a value for artist"},
+		{`artist`, 0, "expected an operator after artist"},
+		{`(artist = "x"`, 0, "expected )"},
+		{`artist = "x" artist = "y"`, 14, `unexpected "artist"`},
+		{`ORDER play_count`, 7, "expected BY after ORDER"},
+		{`ORDER BY tag`, 10, "cannot order by tag"},
+		{`LIMIT 0`, 7, "LIMIT must be a number between 1 and 50000"},
+		{`LIMIT many`, 7, "LIMIT must be a number between 1 and 50000"},
+	}
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.query)
+		var qe *QueryError
+		if !errors.As(err, &qe) {
+			t.Errorf("ParseQuery(%q) error = %v, want a QueryError", tt.query, err)
+			continue
+		}
+		if qe.Column != tt.column || qe.Msg != tt.msg {
+			t.Errorf("ParseQuery(%q) = column %d %q, want column %d %q", tt.query, qe.Column, qe.Msg, tt.column, tt.msg)
+		}
+	}
+}
+
+func TestParseQueryLimits(t *testing.T) {
+	nested := func(depth int, open, close string) string {
+		return strings.Repeat(open, depth) + `artist = "x"` + strings.Repeat(close, depth)
+	}
+	chain := func(n int) string {
+		return strings.TrimSuffix(strings.Repeat(`rating = 1 AND `, n), " AND ")
+	}
+
+	for _, query := range []string{
+		nested(maxQueryDepth, "(", ")"),
+		nested(maxQueryDepth, "NOT ", ""),
+		chain(maxQueryComparisons),
+	} {
+		if _, err := ParseQuery(query); err != nil {
+			t.Errorf("query at the limit rejected: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		msg   string
+	}{
+		{nested(maxQueryDepth+1, "(", ")"), "query is nested more than 16 levels deep"},
+		{nested(maxQueryDepth+1, "NOT ", ""), "query is nested more than 16 levels deep"},
+		{nested(maxQueryDepth/2+1, "NOT (", ")"), "query is nested more than 16 levels deep"},
+		{nested(100000, "(", ")"), "query is nested more than 16 levels deep"},
+		{chain(maxQueryComparisons + 1), "query has more than 200 conditions"},
+	}
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.query)
+		var qe *QueryError
+		if !errors.As(err, &qe) || qe.Msg != tt.msg {
+			t.Errorf("ParseQuery(%.40q...) error = %v, want %q", tt.query, err, tt.msg)
+		}
+	}
+}
+
+func TestQueryLimitsRunInSQLite(t *testing.T) {
+	database, err := db.Connect(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AutoMigrate(&file.Track{}, &file.LibraryEntry{}, &file.Blob{}); err != nil {
+		t.Fatal(err)
+	}
+	// The Sync service owns these; only the columns queries use
+	for _, table := range []string{
+		"CREATE TABLE plays (username TEXT, track_hash TEXT, started_at DATETIME)",
+		"CREATE TABLE annotations (username TEXT, hash TEXT, starred_at DATETIME, rating INTEGER, skip_count INTEGER, tags TEXT)",
+	} {
+		if err := database.Exec(table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Alternating operators nest the SQL deepest
+	alternating := `tag = "x"`
+	for i := 0; i < maxQueryDepth-1; i++ {
+		op := " AND "
+		if i%2 == 0 {
+			op = " OR "
+		}
+		alternating = "(last_played < -3d" + op + alternating + ")"
+	}
+	queries := []string{
+		alternating,
+		strings.Repeat("NOT (", maxQueryDepth/2) + `tag = "x"` + strings.Repeat(")", maxQueryDepth/2),
+		strings.TrimSuffix(strings.Repeat(`NOT tag CONTAINS "x" OR `, maxQueryComparisons), " OR "),
+		strings.TrimSuffix(strings.Repeat(`(rating > 1 OR added < -1d) AND `, maxQueryComparisons/2), " AND "),
+	}
+	for _, query := range queries {
+		q, err := ParseQuery(query)
+		if err != nil {
+			t.Fatalf("ParseQuery(%.40q...): %v", query, err)
+		}
+		var tracks []file.Track
+		if err := q.tracks(database, "alice", time.Now()).Find(&tracks).Error; err != nil {
+			t.Errorf("running %.40q...: %v", query, err)
+		}
+	}
+}
+
+func TestValidQueryLength(t *testing.T) {
+	query := `title = "` + strings.Repeat("x", maxQueryLength) + `"`
+	if err := validQuery(query); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("validQuery of %d bytes: got %v, want InvalidArgument", len(query), err)
+	}
+	deep := strings.Repeat("(", maxQueryDepth+1) + `title = "x"` + strings.Repeat(")", maxQueryDepth+1)
+	if err := validQuery(deep); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("validQuery of a deeply nested query: got %v, want InvalidArgument", err)
+	}
+	if err := validQuery(`title = "x"`); err != nil {
+		t.Errorf("validQuery: %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package playlist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/playlist"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gorm.io/gorm"
+)
+
+const (
+	maxNameLength    = 200
+	maxItemsPerCall  = 5000
+	maxPlaylistItems = 50000
+	maxQueryLength   = 4096
+)
+
+var errSmartPlaylist = status.Errorf(codes.FailedPrecondition, "smart playlists cannot be edited, change their query instead")
+
+type Server struct {
+	pb.UnimplementedPlaylistServiceServer
+	DB *gorm.DB
+	// Events is notified with the username whenever a playlist changes
+	Events *pubsub.Broker
+}
+
+func (s *Server) CreatePlaylist(ctx context.Context, req *pb.CreatePlaylistRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name, err := validName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Query != "" {
+		if err := validQuery(req.Query); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate playlist id")
+	}
+	playlist := Playlist{ID: id, Username: username, Name: name, Query: req.Query}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if playlist.Query != "" {
+			if _, err := playlist.refresh(tx, time.Now()); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&playlist).Error; err != nil {
+			return err
+		}
+		return file.RecordPlaylistChange(tx, username, id, file.ChangeUpsert)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create playlist: %v", err)
+	}
+	s.Events.Publish(username)
+
+	return Load(s.DB, username, id)
+}
+
+func (s *Server) RenamePlaylist(ctx context.Context, req *pb.RenamePlaylistRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name, err := validName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.modify(username, req.PlaylistId, func(tx *gorm.DB, playlist *Playlist) error {
+		return tx.Model(playlist).Update("name", name).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+func (s *Server) DeletePlaylist(ctx context.Context, req *pb.DeletePlaylistRequest) (*emptypb.Empty, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND username = ?", req.PlaylistId, username).Delete(&Playlist{})
+		if result.Error != nil {
+			return status.Errorf(codes.Internal, "failed to delete playlist: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return status.Errorf(codes.NotFound, "playlist not found")
+		}
+		if err := tx.Where("playlist_id = ?", req.PlaylistId).Delete(&Item{}).Error; err != nil {
+			return status.Errorf(codes.Internal, "failed to delete playlist items: %v", err)
+		}
+		if err := file.RecordPlaylistChange(tx, username, req.PlaylistId, file.ChangeDelete); err != nil {
+			return status.Errorf(codes.Internal, "failed to record change: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Events.Publish(username)
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListPlaylists(ctx context.Context, req *emptypb.Empty) (*pb.ListPlaylistsResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Smart playlists report the size of their last refresh
+	var rows []struct {
+		Playlist
+		ItemCount int32
+	}
+	err = s.DB.Model(&Playlist{}).
+		Select("playlists.*, CASE WHEN query <> '' THEN member_count "+
+			"ELSE (SELECT COUNT(*) FROM playlist_items WHERE playlist_items.playlist_id = playlists.id) END AS item_count").
+		Where("username = ?", username).Order("name").Scan(&rows).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playlists: %v", err)
+	}
+
+	resp := &pb.ListPlaylistsResponse{}
+	for i := range rows {
+		playlist := playlistInfo(&rows[i].Playlist)
+		playlist.ItemCount = rows[i].ItemCount
+		resp.Playlists = append(resp.Playlists, playlist)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetPlaylist(ctx context.Context, req *pb.GetPlaylistRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+func (s *Server) AddTracks(ctx context.Context, req *pb.AddTracksRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Hashes) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "hashes are required")
+	}
+	if len(req.Hashes) > maxItemsPerCall {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d tracks per call", maxItemsPerCall)
+	}
+
+	err = s.modify(username, req.PlaylistId, func(tx *gorm.DB, playlist *Playlist) error {
+		if playlist.Query != "" {
+			return errSmartPlaylist
+		}
+		var count int64
+		if err := tx.Model(&Item{}).Where("playlist_id = ?", playlist.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count+int64(len(req.Hashes)) > maxPlaylistItems {
+			return status.Errorf(codes.ResourceExhausted, "playlists are limited to %d tracks", maxPlaylistItems)
+		}
+
+		var owned int64
+		err := tx.Model(&file.LibraryEntry{}).Where("username = ? AND hash IN ?", username, req.Hashes).
+			Distinct("hash").Count(&owned).Error
+		if err != nil {
+			return err
+		}
+		if int(owned) != countDistinct(req.Hashes) {
+			return status.Errorf(codes.NotFound, "track not found in library")
+		}
+
+		gap := func() (string, string, error) { return gapAtEnd(tx, playlist.ID) }
+		if req.AfterItemId != "" {
+			gap = func() (string, string, error) { return gapAfter(tx, playlist.ID, req.AfterItemId) }
+		}
+		before, after, err := gap()
+		if err != nil {
+			return err
+		}
+		positions := keysBetween(before, after, len(req.Hashes))
+		for i, hash := range req.Hashes {
+			id, err := newID()
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&Item{ID: id, PlaylistID: playlist.ID, Hash: hash, Position: positions[i]}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+func (s *Server) RemoveItems(ctx context.Context, req *pb.RemoveItemsRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Items already removed by another device are ignored
+	err = s.modify(username, req.PlaylistId, func(tx *gorm.DB, playlist *Playlist) error {
+		if playlist.Query != "" {
+			return errSmartPlaylist
+		}
+		if len(req.ItemIds) == 0 {
+			return nil
+		}
+		return tx.Where("playlist_id = ? AND id IN ?", playlist.ID, req.ItemIds).Delete(&Item{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+func (s *Server) MoveItem(ctx context.Context, req *pb.MoveItemRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.ItemId == req.AfterItemId {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot move an item after itself")
+	}
+
+	err = s.modify(username, req.PlaylistId, func(tx *gorm.DB, playlist *Playlist) error {
+		if playlist.Query != "" {
+			return errSmartPlaylist
+		}
+		var item Item
+		if err := tx.Where("id = ? AND playlist_id = ?", req.ItemId, playlist.ID).First(&item).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return status.Errorf(codes.NotFound, "item not found")
+			}
+			return err
+		}
+
+		// Take the item out first so it is not its own neighbour
+		before, after, err := gapAfter(tx.Where("id <> ?", item.ID), playlist.ID, req.AfterItemId)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&item).Update("position", keyBetween(before, after)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+// modify runs fn on the user's playlist in a transaction, then bumps the
+// playlist and records the change. Errors are returned as gRPC status errors.
+func (s *Server) modify(username, playlistID string, fn func(tx *gorm.DB, playlist *Playlist) error) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var playlist Playlist
+		if err := tx.Where("id = ? AND username = ?", playlistID, username).First(&playlist).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return status.Errorf(codes.NotFound, "playlist not found")
+			}
+			return err
+		}
+		if err := fn(tx, &playlist); err != nil {
+			return err
+		}
+		if err := respace(tx, playlist.ID); err != nil {
+			return err
+		}
+		if err := tx.Model(&playlist).Update("updated_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return file.RecordPlaylistChange(tx, username, playlistID, file.ChangeUpsert)
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "failed to update playlist: %v", err)
+	}
+	s.Events.Publish(username)
+	return nil
+}
+
+// gapAfter returns the positions around the slot right after afterItemID,
+// or at the start of the playlist if it is empty. db may carry extra
+// conditions on the items considered.
+func gapAfter(db *gorm.DB, playlistID, afterItemID string) (string, string, error) {
+	before := ""
+	if afterItemID != "" {
+		var after Item
+		err := db.Session(&gorm.Session{}).Where("id = ? AND playlist_id = ?", afterItemID, playlistID).First(&after).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", "", status.Errorf(codes.NotFound, "item %s not found", afterItemID)
+		}
+		if err != nil {
+			return "", "", err
+		}
+		before = after.Position
+	}
+
+	var next Item
+	err := db.Session(&gorm.Session{}).Where("playlist_id = ? AND position > ?", playlistID, before).
+		Order("position, id").Limit(1).Find(&next).Error
+	return before, next.Position, err
+}
+
+// respace gives the items of a playlist evenly spread positions once its
+// keys have grown too long. Clients refer to items by ID, so this is
+// invisible to them.
+func respace(tx *gorm.DB, playlistID string) error {
+	var longest int
+	err := tx.Model(&Item{}).Where("playlist_id = ?", playlistID).
+		Select("COALESCE(MAX(LENGTH(position)), 0)").Scan(&longest).Error
+	if err != nil || longest <= maxKeyLength {
+		return err
+	}
+
+	var ids []string
+	if err := tx.Model(&Item{}).Where("playlist_id = ?", playlistID).Order("position, id").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for i, key := range spacedKeys(len(ids)) {
+		if err := tx.Model(&Item{}).Where("id = ?", ids[i]).Update("position", key).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gapAtEnd returns the positions around the slot after the last item.
+func gapAtEnd(db *gorm.DB, playlistID string) (string, string, error) {
+	var last Item
+	err := db.Where("playlist_id = ?", playlistID).Order("position DESC, id DESC").Limit(1).Find(&last).Error
+	return last.Position, "", err
+}
+
+func validName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", status.Errorf(codes.InvalidArgument, "name is required")
+	}
+	if len(name) > maxNameLength {
+		return "", status.Errorf(codes.InvalidArgument, "name is longer than %d bytes", maxNameLength)
+	}
+	return name, nil
+}
+
+func countDistinct(values []string) int {
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,153 @@
+package playlist
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/playlist"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+func (s *Server) SetPlaylistQuery(ctx context.Context, req *pb.SetPlaylistQueryRequest) (*pb.Playlist, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validQuery(req.Query); err != nil {
+		return nil, err
+	}
+
+	err = s.modify(username, req.PlaylistId, func(tx *gorm.DB, playlist *Playlist) error {
+		if playlist.Query == "" {
+			return status.Errorf(codes.FailedPrecondition, "not a smart playlist")
+		}
+		playlist.Query = req.Query
+		if _, err := playlist.refresh(tx, time.Now()); err != nil {
+			return err
+		}
+		return tx.Model(playlist).Updates(map[string]interface{}{
+			"query":        playlist.Query,
+			"membership":   playlist.Membership,
+			"member_count": playlist.MemberCount,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(s.DB, username, req.PlaylistId)
+}
+
+// validQuery parses a smart playlist query. Errors are returned as gRPC
+// status errors.
+func validQuery(query string) error {
+	if query == "" {
+		return status.Errorf(codes.InvalidArgument, "query is required")
+	}
+	if len(query) > maxQueryLength {
+		return status.Errorf(codes.InvalidArgument, "query is longer than %d bytes", maxQueryLength)
+	}
+	if _, err := ParseQuery(query); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+	}
+	return nil
+}
+
+// refresh evaluates a smart playlist as of now and updates its Membership
+// and MemberCount. It reports whether the tracks changed.
+func (p *Playlist) refresh(db *gorm.DB, now time.Time) (bool, error) {
+	items, err := resolve(db, p, now)
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	for _, item := range items {
+		h.Write([]byte(item.Hash))
+		h.Write([]byte{'\n'})
+	}
+	membership := hex.EncodeToString(h.Sum(nil)[:16])
+
+	changed := membership != p.Membership
+	p.Membership = membership
+	p.MemberCount = len(items)
+	return changed, nil
+}
+
+// RefreshSmartPlaylists re-evaluates every smart playlist and records a
+// change for those whose tracks changed, which also covers queries on
+// times relative to now. It returns the number of playlists that changed.
+func RefreshSmartPlaylists(db *gorm.DB, events *pubsub.Broker, now time.Time) (int, error) {
+	var playlists []Playlist
+	if err := db.Where("query <> ''").Find(&playlists).Error; err != nil {
+		return 0, err
+	}
+
+	var changed int
+	var errs []error
+	for i := range playlists {
+		p := &playlists[i]
+		query := p.Query
+		ok, err := p.refresh(db, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		updated := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// Skip playlists whose query was changed meanwhile
+			result := tx.Model(&Playlist{}).Where("id = ? AND query = ?", p.ID, query).Updates(map[string]interface{}{
+				"membership":   p.Membership,
+				"member_count": p.MemberCount,
+				"updated_at":   now,
+			})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			updated = true
+			return file.RecordPlaylistChange(tx, p.Username, p.ID, file.ChangeUpsert)
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if updated {
+			changed++
+			events.Publish(p.Username)
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// RunSmartRefresher re-evaluates smart playlists every interval until ctx
+// is cancelled.
+func RunSmartRefresher(ctx context.Context, db *gorm.DB, events *pubsub.Broker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := RefreshSmartPlaylists(db, events, time.Now())
+			if err != nil {
+				log.Printf("Smart playlist refresh failed: %v", err)
+			}
+			if changed > 0 {
+				log.Printf("Smart playlist refresh updated %d playlists", changed)
+			}
+		}
+	}
+}
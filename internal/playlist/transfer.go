@@ -0,0 +1,200 @@
+package playlist
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/playlist"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+const defaultImportName = "Imported playlist"
+
+var formats = map[pb.PlaylistFormat]Format{
+	pb.PlaylistFormat_PLAYLIST_FORMAT_M3U:  FormatM3U,
+	pb.PlaylistFormat_PLAYLIST_FORMAT_PLS:  FormatPLS,
+	pb.PlaylistFormat_PLAYLIST_FORMAT_XSPF: FormatXSPF,
+}
+
+func (s *Server) ImportPlaylist(ctx context.Context, req *pb.ImportPlaylistRequest) (*pb.ImportPlaylistResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	format, ok := formats[req.Format]
+	if req.Format == pb.PlaylistFormat_PLAYLIST_FORMAT_UNSPECIFIED {
+		format, ok = DetectFormat(req.Data), true
+	}
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported format %s", req.Format)
+	}
+
+	resp, err := Import(s.DB, username, req.Name, format, req.Data)
+	if err != nil {
+		return nil, err
+	}
+	s.Events.Publish(username)
+	return resp, nil
+}
+
+func (s *Server) ExportPlaylist(ctx context.Context, req *pb.ExportPlaylistRequest) (*pb.ExportPlaylistResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	format, ok := formats[req.Format]
+	if req.Format == pb.PlaylistFormat_PLAYLIST_FORMAT_UNSPECIFIED {
+		format, ok = FormatM3U, true
+	}
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported format %s", req.Format)
+	}
+	urlPrefix := ""
+	if req.Reference == pb.PlaylistReference_PLAYLIST_REFERENCE_URL {
+		if req.UrlPrefix == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "url_prefix is required for URL references")
+		}
+		urlPrefix = req.UrlPrefix
+	}
+
+	return Export(s.DB, username, req.PlaylistId, format, urlPrefix)
+}
+
+// Import creates a playlist for the user from a playlist file, matching its
+// entries to library tracks with MatchEntries. An empty name takes the
+// title from the file. Errors are returned as gRPC status errors.
+func Import(db *gorm.DB, username, name string, format Format, data []byte) (*pb.ImportPlaylistResponse, error) {
+	title, entries, err := Parse(format, data)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse playlist: %v", err)
+	}
+	if len(entries) > maxPlaylistItems {
+		return nil, status.Errorf(codes.InvalidArgument, "playlists are limited to %d tracks", maxPlaylistItems)
+	}
+	if name == "" {
+		name = title
+	}
+	if name == "" {
+		name = defaultImportName
+	}
+	name, err = validName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := MatchEntries(db, username, entries)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to match tracks: %v", err)
+	}
+
+	resp := &pb.ImportPlaylistResponse{}
+	var hashes []string
+	for i, m := range matches {
+		switch m.By {
+		case MatchFilename:
+			resp.MatchedByFilename++
+		case MatchTags:
+			resp.MatchedByTags++
+		default:
+			e := entries[i]
+			resp.Unmatched = append(resp.Unmatched, &pb.UnmatchedEntry{
+				Index:    int32(i),
+				Location: e.Location,
+				Title:    e.Title,
+				Artist:   e.Artist,
+				Duration: e.Duration,
+			})
+			continue
+		}
+		hashes = append(hashes, m.Hash)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate playlist id")
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&Playlist{ID: id, Username: username, Name: name}).Error; err != nil {
+			return err
+		}
+		for i, position := range spacedKeys(len(hashes)) {
+			itemID, err := newID()
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&Item{ID: itemID, PlaylistID: id, Hash: hashes[i], Position: position}).Error; err != nil {
+				return err
+			}
+		}
+		return file.RecordPlaylistChange(tx, username, id, file.ChangeUpsert)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create playlist: %v", err)
+	}
+
+	resp.Playlist, err = Load(db, username, id)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Export writes the user's playlist as a playlist file. Entries reference
+// the filename each track was uploaded with, or urlPrefix followed by the
+// content hash if urlPrefix is set. Errors are returned as gRPC status
+// errors.
+func Export(db *gorm.DB, username, playlistID string, format Format, urlPrefix string) (*pb.ExportPlaylistResponse, error) {
+	playlist, err := find(db, username, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	items, err := resolve(db, playlist, time.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playlist items: %v", err)
+	}
+
+	entries := make([]Entry, len(items))
+	for i, r := range items {
+		location := r.Filename
+		if urlPrefix != "" || location == "" {
+			location = urlPrefix + r.Hash
+		}
+		entries[i] = Entry{
+			Location: location,
+			Title:    r.Title,
+			Artist:   r.Artist,
+			Album:    r.Album,
+			Duration: r.Duration,
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, format, playlist.Name, entries); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to write playlist: %v", err)
+	}
+	return &pb.ExportPlaylistResponse{
+		Data:        buf.Bytes(),
+		ContentType: format.ContentType(),
+		Filename:    exportFilename(playlist.Name, format),
+	}, nil
+}
+
+// exportFilename turns a playlist name into a file name that is safe on
+// common filesystems.
+func exportFilename(name string, format Format) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return name + "." + format.Extension()
+}
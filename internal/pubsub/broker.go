@@ -0,0 +1,59 @@
+// Package pubsub is an in-process notification hub. Subscribers are only
+// told that something happened on a topic, not what; they re-read the
+// current state themselves, so notifications can be coalesced and dropped
+// without losing anything.
+package pubsub
+
+import "sync"
+
+// Broker fans out notifications to the subscribers of a topic. A nil
+// *Broker is valid and drops everything.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value whenever topic is
+// published, and a function to unsubscribe. Notifications arriving while
+// one is pending are merged into it.
+func (b *Broker) Subscribe(topic string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	if b == nil {
+		return ch, func() {}
+	}
+
+	b.mu.Lock()
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[chan struct{}]struct{})
+	}
+	b.subs[topic][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[topic], ch)
+		if len(b.subs[topic]) == 0 {
+			delete(b.subs, topic)
+		}
+	}
+}
+
+// Publish notifies the subscribers of topic without blocking.
+func (b *Broker) Publish(topic string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[topic] {
+		select {
+		case ch <- struct{}{}:
+		default: // Already pending
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	maxStarHashes = 1000
+	maxTags       = 32
+	maxTagLength  = 64
+	maxRating     = 5
+)
+
+func (s *Server) StarTracks(ctx context.Context, req *pb.StarTracksRequest) (*pb.ListAnnotationsResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Hashes) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "hashes are required")
+	}
+	if len(req.Hashes) > maxStarHashes {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d hashes per call", maxStarHashes)
+	}
+
+	now := time.Now()
+	resp := &pb.ListAnnotationsResponse{}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		for _, hash := range req.Hashes {
+			a, err := updateAnnotation(tx, username, hash, func(a *Annotation) {
+				switch {
+				case !req.Starred:
+					a.StarredAt = nil
+				case a.StarredAt == nil:
+					a.StarredAt = &now // Keep when it was first starred
+				}
+			})
+			if err != nil {
+				return err
+			}
+			resp.Annotations = append(resp.Annotations, annotationInfo(a))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, annotationError(err)
+	}
+	s.Events.Publish(username)
+	return resp, nil
+}
+
+func (s *Server) RateTrack(ctx context.Context, req *pb.RateTrackRequest) (*pb.TrackAnnotation, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Rating < 0 || req.Rating > maxRating {
+		return nil, status.Errorf(codes.InvalidArgument, "rating must be between 1 and %d, or 0 to clear it", maxRating)
+	}
+
+	var a *Annotation
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		a, err = updateAnnotation(tx, username, req.Hash, func(a *Annotation) {
+			a.Rating = req.Rating
+		})
+		return err
+	})
+	if err != nil {
+		return nil, annotationError(err)
+	}
+	s.Events.Publish(username)
+	return annotationInfo(a), nil
+}
+
+func (s *Server) SetTrackTags(ctx context.Context, req *pb.SetTrackTagsRequest) (*pb.TrackAnnotation, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags are trimmed and deduplicated ignoring case, keeping their order
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range req.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, status.Errorf(codes.InvalidArgument, "tags are limited to %d bytes", maxTagLength)
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d tags per track", maxTags)
+	}
+	encoded := ""
+	if len(tags) > 0 {
+		b, err := json.Marshal(tags)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode tags: %v", err)
+		}
+		encoded = string(b)
+	}
+
+	var a *Annotation
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		a, err = updateAnnotation(tx, username, req.Hash, func(a *Annotation) {
+			a.Tags = encoded
+		})
+		return err
+	})
+	if err != nil {
+		return nil, annotationError(err)
+	}
+	s.Events.Publish(username)
+	return annotationInfo(a), nil
+}
+
+func (s *Server) ListAnnotations(ctx context.Context, req *pb.ListAnnotationsRequest) (*pb.ListAnnotationsResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := s.DB.Where("username = ?", username)
+	if len(req.Hashes) > 0 {
+		query = query.Where("hash IN ?", req.Hashes)
+	}
+	if req.Starred {
+		query = query.Where("starred_at IS NOT NULL")
+	}
+	if req.MinRating > 0 {
+		query = query.Where("rating >= ?", req.MinRating)
+	}
+	if req.Tag != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM json_each(NULLIF(annotations.tags, '')) WHERE LOWER(json_each.value) = LOWER(?))", req.Tag)
+	}
+
+	var annotations []Annotation
+	if err := query.Order("updated_at DESC, hash").Find(&annotations).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch annotations: %v", err)
+	}
+	resp := &pb.ListAnnotationsResponse{}
+	for i := range annotations {
+		resp.Annotations = append(resp.Annotations, annotationInfo(&annotations[i]))
+	}
+	return resp, nil
+}
+
+// errNotInLibrary is returned when annotating a track outside the library.
+var errNotInLibrary = errors.New("track not found in library")
+
+// updateAnnotation applies fn to the user's annotation of hash, which must
+// be in the user's library, and records the change so other devices pick it
+// up. Annotations left empty are removed.
+func updateAnnotation(tx *gorm.DB, username, hash string, fn func(*Annotation)) (*Annotation, error) {
+	owned, err := file.InUserLibrary(tx, username, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !owned {
+		return nil, errNotInLibrary
+	}
+
+	a := &Annotation{Username: username, Hash: hash}
+	if err := tx.Where("username = ? AND hash = ?", username, hash).Limit(1).Find(a).Error; err != nil {
+		return nil, err
+	}
+	fn(a)
+	if a.empty() {
+		err = tx.Delete(a).Error
+	} else {
+		err = tx.Save(a).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, file.RecordChange(tx, username, hash, file.ChangeUpsert)
+}
+
+func (a *Annotation) empty() bool {
+	return a.StarredAt == nil && a.Rating == 0 && a.Tags == "" && a.SkipCount == 0
+}
+
+func annotationError(err error) error {
+	if errors.Is(err, errNotInLibrary) {
+		return status.Errorf(codes.NotFound, "%v", err)
+	}
+	return status.Errorf(codes.Internal, "failed to save annotation: %v", err)
+}
+
+// countSkips adds skipped plays to the user's skip counts.
+func countSkips(tx *gorm.DB, username string, skips map[string]int32) error {
+	for hash, n := range skips {
+		a := &Annotation{Username: username, Hash: hash}
+		if err := tx.Where("username = ? AND hash = ?", username, hash).Limit(1).Find(a).Error; err != nil {
+			return err
+		}
+		a.SkipCount += n
+		if err := tx.Save(a).Error; err != nil {
+			return err
+		}
+		// Only tracks in the library are in the change feed
+		owned, err := file.InUserLibrary(tx, username, hash)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			continue
+		}
+		if err := file.RecordChange(tx, username, hash, file.ChangeUpsert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotationsOf returns the user's annotations of hashes, or all of them if
+// hashes is nil, by hash.
+func (s *Server) annotationsOf(username string, hashes []string) (map[string]*pb.TrackAnnotation, error) {
+	query := s.DB.Where("username = ?", username)
+	if hashes != nil {
+		query = query.Where("hash IN ?", hashes)
+	}
+	var annotations []Annotation
+	if err := query.Find(&annotations).Error; err != nil {
+		return nil, err
+	}
+	byHash := make(map[string]*pb.TrackAnnotation, len(annotations))
+	for i := range annotations {
+		byHash[annotations[i].Hash] = annotationInfo(&annotations[i])
+	}
+	return byHash, nil
+}
+
+func annotationInfo(a *Annotation) *pb.TrackAnnotation {
+	info := &pb.TrackAnnotation{
+		Hash:      a.Hash,
+		Rating:    a.Rating,
+		SkipCount: a.SkipCount,
+	}
+	if a.StarredAt != nil {
+		info.StarredAt = timestamppb.New(*a.StarredAt)
+	}
+	if !a.UpdatedAt.IsZero() {
+		info.UpdatedAt = timestamppb.New(a.UpdatedAt)
+	}
+	if a.Tags != "" {
+		// Written by SetTrackTags; a row that does not decode loses its tags
+		// rather than failing the whole response
+		if err := json.Unmarshal([]byte(a.Tags), &info.Tags); err != nil {
+			log.Printf("Invalid tags of %s for %s: %v", a.Hash, a.Username, err)
+		}
+	}
+	return info
+}
@@ -0,0 +1,175 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/playlist"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 5000
+)
+
+func (s *Server) GetChanges(ctx context.Context, req *pb.GetChangesRequest) (*pb.GetChangesResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultChangesLimit
+	}
+	if limit > maxChangesLimit {
+		limit = maxChangesLimit
+	}
+
+	resp, err := s.changesSince(claims.Username, claims.DeviceID, req.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.ResyncRequired {
+		s.touchDevice(ctx, resp.Cursor)
+	}
+	return resp, nil
+}
+
+// changesSince returns up to limit changes in the user's library after
+// cursor, as seen through the sync rules of deviceID if it is not empty, or
+// a response asking for a full resync if the cursor cannot be served.
+func (s *Server) changesSince(username, deviceID string, cursor int64, limit int) (*pb.GetChangesResponse, error) {
+	compacted, err := file.CompactedThrough(s.DB)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read change log state: %v", err)
+	}
+	latest, err := file.LatestChange(s.DB)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read change log: %v", err)
+	}
+	// Cursors only come from GetSync or GetChanges; anything else cannot be
+	// served incrementally
+	if cursor <= 0 || uint(cursor) < compacted || uint(cursor) > latest {
+		return &pb.GetChangesResponse{Cursor: int64(latest), ResyncRequired: true}, nil
+	}
+	pending, err := s.resyncPending(username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read sync settings: %v", err)
+	}
+	if pending {
+		return &pb.GetChangesResponse{Cursor: int64(latest), ResyncRequired: true}, nil
+	}
+
+	var changes []file.Change
+	err = s.DB.Where("username = ? AND id > ?", username, cursor).
+		Order("id").Limit(limit + 1).Find(&changes).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch changes: %v", err)
+	}
+
+	resp := &pb.GetChangesResponse{Cursor: cursor}
+	if len(changes) > limit {
+		changes = changes[:limit]
+		resp.HasMore = true
+	}
+	if len(changes) == 0 {
+		return resp, nil
+	}
+	resp.Cursor = int64(changes[len(changes)-1].ID)
+
+	// A change only says the track or playlist changed; report its current
+	// state once
+	var hashes, playlistIDs []string
+	seen := make(map[string]bool)
+	for _, c := range changes {
+		switch {
+		case c.PlaylistID != "" && !seen["playlist/"+c.PlaylistID]:
+			seen["playlist/"+c.PlaylistID] = true
+			playlistIDs = append(playlistIDs, c.PlaylistID)
+		case c.PlaylistID == "" && !seen[c.Hash]:
+			seen[c.Hash] = true
+			hashes = append(hashes, c.Hash)
+		}
+	}
+
+	// Playlists the device syncs by changed, so its selection has to be
+	// rebuilt
+	byPlaylist, err := s.playlistRules(username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read sync rules: %v", err)
+	}
+	for _, id := range playlistIDs {
+		if byPlaylist[id] {
+			return &pb.GetChangesResponse{Cursor: int64(latest), ResyncRequired: true}, nil
+		}
+	}
+
+	for _, id := range playlistIDs {
+		change := &pb.PlaylistChange{Kind: pb.ChangeKind_CHANGE_KIND_DELETE, PlaylistId: id}
+		current, err := playlist.Load(s.DB, username, id)
+		switch status.Code(err) {
+		case codes.OK:
+			change.Kind = pb.ChangeKind_CHANGE_KIND_UPSERT
+			change.Playlist = current
+		case codes.NotFound:
+		default:
+			return nil, err
+		}
+		resp.PlaylistChanges = append(resp.PlaylistChanges, change)
+	}
+	if len(hashes) == 0 {
+		return resp, nil
+	}
+
+	// Under a storage budget any track change can push other tracks in or
+	// out of the selection, which the change log says nothing about
+	budgeted, err := s.storageBudgeted(username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read sync settings: %v", err)
+	}
+	if budgeted {
+		return &pb.GetChangesResponse{Cursor: int64(latest), ResyncRequired: true}, nil
+	}
+
+	var tracks []file.Track
+	err = s.DB.Scopes(file.InLibrary(username), file.Playable).
+		Where("tracks.hash IN ?", hashes).Find(&tracks).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch tracks: %v", err)
+	}
+	current := make(map[string]*file.Track, len(tracks))
+	for i := range tracks {
+		current[tracks[i].Hash] = &tracks[i]
+	}
+
+	// Tracks the rules no longer select are deletions for the device
+	selected, err := s.selectTracks(username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to apply sync rules: %v", err)
+	}
+	annotations, err := s.annotationsOf(username, hashes)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch annotations: %v", err)
+	}
+
+	for _, hash := range hashes {
+		change := &pb.TrackChange{Kind: pb.ChangeKind_CHANGE_KIND_DELETE, Hash: hash}
+		if t, ok := current[hash]; ok {
+			ruleID, ok := selected[hash]
+			if selected == nil || ok {
+				change.Kind = pb.ChangeKind_CHANGE_KIND_UPSERT
+				change.File = fileInfo(t)
+				change.File.RuleId = uint64(ruleID)
+				change.File.Annotation = annotations[hash]
+			}
+		}
+		resp.Changes = append(resp.Changes, change)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,276 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Upper bound on hashes in a single ReportLocalTracks call
+const maxReportedHashes = 50000
+
+// hashQueryBatch keeps IN lists well below SQLite's variable limit.
+const hashQueryBatch = 500
+
+// touchDevice records that the calling device was seen and, unless cursor is
+// negative, the change cursor it was handed. Calls without a device-scoped
+// token are ignored. Failures are only logged.
+func (s *Server) touchDevice(ctx context.Context, cursor int64) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok || claims.DeviceID == "" {
+		return
+	}
+	if err := saveDeviceState(s.DB, claims.Username, claims.DeviceID, cursor); err != nil {
+		log.Printf("Failed to update state of device %s: %v", claims.DeviceID, err)
+	}
+}
+
+func saveDeviceState(db *gorm.DB, username, deviceID string, cursor int64) error {
+	state := DeviceState{DeviceID: deviceID, Username: username, LastSeenAt: time.Now()}
+	update := []string{"last_seen_at", "updated_at"}
+	if cursor >= 0 {
+		state.Cursor = cursor
+		update = append(update, "cursor")
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns(update),
+	}).Create(&state).Error
+}
+
+func (s *Server) ReportLocalTracks(ctx context.Context, req *pb.ReportLocalTracksRequest) (*emptypb.Empty, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if claims.DeviceID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "token is not scoped to a device")
+	}
+	if len(req.Added)+len(req.Removed) > maxReportedHashes {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d hashes per call", maxReportedHashes)
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveDeviceState(tx, claims.Username, claims.DeviceID, -1); err != nil {
+			return err
+		}
+		if req.Replace {
+			if err := tx.Where("device_id = ?", claims.DeviceID).Delete(&DeviceTrack{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(req.Removed) > 0 {
+			if err := tx.Where("device_id = ? AND hash IN ?", claims.DeviceID, req.Removed).Delete(&DeviceTrack{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(req.Added) == 0 {
+			return nil
+		}
+
+		// Only tracks in the library are recorded, anything else the device
+		// stores is none of the server's business
+		var tracks []DeviceTrack
+		for start := 0; start < len(req.Added); start += hashQueryBatch {
+			var hashes []string
+			err := tx.Model(&file.Track{}).Scopes(file.InLibrary(claims.Username)).
+				Where("tracks.hash IN ?", req.Added[start:min(start+hashQueryBatch, len(req.Added))]).
+				Distinct().Pluck("tracks.hash", &hashes).Error
+			if err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				tracks = append(tracks, DeviceTrack{DeviceID: claims.DeviceID, Hash: hash})
+			}
+		}
+		if len(tracks) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(tracks, 500).Error
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save local tracks: %v", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListDeviceStates(ctx context.Context, req *emptypb.Empty) (*pb.ListDeviceStatesResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []DeviceState
+	if err := s.DB.Where("username = ?", username).Order("last_seen_at DESC").Find(&states).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch devices: %v", err)
+	}
+	if len(states) == 0 {
+		return &pb.ListDeviceStatesResponse{}, nil
+	}
+
+	// The library and local tracks are loaded once for all devices
+	library, err := s.sizedLibrary(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch library: %v", err)
+	}
+	deviceIDs := make([]string, len(states))
+	for i, state := range states {
+		deviceIDs[i] = state.DeviceID
+	}
+	var reported []DeviceTrack
+	if err := s.DB.Where("device_id IN ?", deviceIDs).Find(&reported).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch local tracks: %v", err)
+	}
+	local := make(map[string]map[string]bool, len(states))
+	for _, t := range reported {
+		if local[t.DeviceID] == nil {
+			local[t.DeviceID] = make(map[string]bool)
+		}
+		local[t.DeviceID][t.Hash] = true
+	}
+
+	resp := &pb.ListDeviceStatesResponse{}
+	for _, state := range states {
+		selected, err := s.selectFrom(username, state.DeviceID, library)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count missing tracks: %v", err)
+		}
+		var missing int32
+		for i := range library {
+			hash := library[i].Hash
+			if _, ok := selected[hash]; (selected == nil || ok) && !local[state.DeviceID][hash] {
+				missing++
+			}
+		}
+		resp.Devices = append(resp.Devices, &pb.DeviceState{
+			DeviceId:      state.DeviceID,
+			Cursor:        state.Cursor,
+			LastSeenAt:    timestamppb.New(state.LastSeenAt),
+			LocalTracks:   int32(len(local[state.DeviceID])),
+			MissingTracks: missing,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) GetMissingTracks(ctx context.Context, req *pb.GetMissingTracksRequest) (*pb.GetMissingTracksResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	deviceID := req.DeviceId
+	if deviceID == "" {
+		deviceID = claims.DeviceID
+	}
+
+	var state DeviceState
+	err := s.DB.Where("device_id = ? AND username = ?", deviceID, claims.Username).First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Errorf(codes.NotFound, "device not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch device: %v", err)
+	}
+
+	tracks, err := s.missingTracks(claims.Username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch tracks: %v", err)
+	}
+
+	hashes := make([]string, len(tracks))
+	for i := range tracks {
+		hashes[i] = tracks[i].Hash
+	}
+	annotations, err := s.annotationsOf(claims.Username, hashes)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch annotations: %v", err)
+	}
+
+	resp := &pb.GetMissingTracksResponse{}
+	for i := range tracks {
+		info := fileInfo(&tracks[i])
+		info.Annotation = annotations[info.Hash]
+		resp.Files = append(resp.Files, info)
+	}
+	return resp, nil
+}
+
+// missingTracks returns the tracks selected for the device that it has not
+// reported as local.
+func (s *Server) missingTracks(username, deviceID string) ([]file.Track, error) {
+	var tracks []file.Track
+	err := s.DB.Scopes(file.InLibrary(username), file.Playable).
+		Where("tracks.hash NOT IN (?)", s.DB.Model(&DeviceTrack{}).Select("hash").Where("device_id = ?", deviceID)).
+		Find(&tracks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := s.selectTracks(username, deviceID)
+	if err != nil || selected == nil {
+		return tracks, err
+	}
+	missing := tracks[:0]
+	for _, t := range tracks {
+		if _, ok := selected[t.Hash]; ok {
+			missing = append(missing, t)
+		}
+	}
+	return missing, nil
+}
+
+// ExpireDeviceStates deletes what is known about devices not seen for ttl,
+// which covers devices revoked with the Auth service since they cannot call
+// anymore. It returns the number of devices removed.
+func ExpireDeviceStates(db *gorm.DB, ttl time.Duration) (int, error) {
+	var ids []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DeviceState{}).Where("last_seen_at < ?", time.Now().Add(-ttl)).Pluck("device_id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, model := range []interface{}{&DeviceTrack{}, &SyncRule{}, &DeviceSyncSettings{}, &PlaybackState{}, &DeviceState{}} {
+			if err := tx.Where("device_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(ids), err
+}
+
+// RunDeviceExpiry expires device states every interval until ctx is
+// cancelled.
+func RunDeviceExpiry(ctx context.Context, db *gorm.DB, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := ExpireDeviceStates(db, ttl)
+			if err != nil {
+				log.Printf("Device state expiry failed: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("Expired the state of %d inactive devices", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package sync
+
+import "time"
+
+// DeviceState is what the Sync service knows about a registered device. The
+// device itself is registered with the Auth service and identified by the
+// device_id claim of its token.
+type DeviceState struct {
+	DeviceID   string `gorm:"primaryKey"`
+	Username   string `gorm:"index"`
+	Cursor     int64  // Last change cursor handed to the device
+	LastSeenAt time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// DeviceTrack records that a device reported a track as stored locally.
+type DeviceTrack struct {
+	DeviceID string `gorm:"primaryKey"`
+	Hash     string `gorm:"primaryKey"`
+}
+
+// Sync rule actions
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+// Sync rule fields; RuleFieldAll matches every track
+const (
+	RuleFieldAll    = "all"
+	RuleFieldArtist = "artist"
+	RuleFieldAlbum  = "album"
+	RuleFieldFormat = "format"
+	// RuleFieldPlaylist matches the tracks in the playlist with ID Value
+	RuleFieldPlaylist = "playlist"
+)
+
+// SyncRule selects tracks for a device. Rules are evaluated in Position
+// order and the first one matching a track decides whether it is synced.
+type SyncRule struct {
+	ID       uint   `gorm:"primaryKey"`
+	Username string `gorm:"index:idx_sync_rule_device,priority:1"`
+	DeviceID string `gorm:"index:idx_sync_rule_device,priority:2"`
+	Position int
+	Action   string
+	Field    string
+	Value    string
+	// MaxSize limits the rule to files of at most this many bytes, 0 for any
+	MaxSize   int64
+	CreatedAt time.Time
+}
+
+// DeviceSyncSettings holds the per-device options that go with its rules.
+type DeviceSyncSettings struct {
+	Username string `gorm:"primaryKey"`
+	DeviceID string `gorm:"primaryKey"`
+	// StorageBudget caps the total size of selected files, 0 for no cap
+	StorageBudget int64
+	// ResyncPending is set when the rules change, since the device's change
+	// cursor no longer describes what it should hold
+	ResyncPending bool
+	UpdatedAt     time.Time
+}
+
+// PlaybackState is the last playback report of a device. The user's current
+// state is the report with the latest device timestamp.
+type PlaybackState struct {
+	Username   string `gorm:"primaryKey"`
+	DeviceID   string `gorm:"primaryKey"`
+	TrackHash  string
+	PositionMs int64
+	Playing    bool
+	Queue      string // JSON array of hashes
+	QueueIndex int32
+	// ReportedAt is the device clock at the time of the report, capped at
+	// the server clock
+	ReportedAt time.Time `gorm:"index"`
+	UpdatedAt  time.Time
+}
+
+// Play is a single listen reported by a device. IdempotencyKey is chosen by
+// the client so batches can be retried without counting plays twice.
+type Play struct {
+	ID             uint   `gorm:"primaryKey"`
+	Username       string `gorm:"uniqueIndex:idx_play_user_key,priority:1;index:idx_play_user_started,priority:1"`
+	IdempotencyKey string `gorm:"uniqueIndex:idx_play_user_key,priority:2"`
+	DeviceID       string
+	TrackHash      string    `gorm:"index"`
+	StartedAt      time.Time `gorm:"index:idx_play_user_started,priority:2"`
+	PlayedMs       int64
+	// Offline is set for plays buffered on the device and reported later
+	Offline bool
+	// Skipped plays count towards the track's Annotation.SkipCount
+	Skipped   bool
+	CreatedAt time.Time
+}
+
+// Annotation is a user's personal data about a track. It is keyed by
+// content hash rather than track row, so it survives the track leaving the
+// library and applies again when the same content is uploaded.
+type Annotation struct {
+	Username  string `gorm:"primaryKey"`
+	Hash      string `gorm:"primaryKey"`
+	StarredAt *time.Time
+	Rating    int32  // 1-5, 0 for unrated
+	Tags      string // JSON array
+	SkipCount int32
+	UpdatedAt time.Time
+}
@@ -0,0 +1,187 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxQueueLength = 10000
+
+// playbackTopic is the Events topic notified when a user's playback changes.
+func playbackTopic(username string) string {
+	return "playback/" + username
+}
+
+func (s *Server) ReportPlayback(ctx context.Context, req *pb.PlaybackState) (*pb.ReportPlaybackResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if claims.DeviceID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "token is not scoped to a device")
+	}
+	if len(req.Queue) > maxQueueLength {
+		return nil, status.Errorf(codes.InvalidArgument, "queue is limited to %d tracks", maxQueueLength)
+	}
+	if req.PositionMs < 0 || req.QueueIndex < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "position_ms and queue_index must not be negative")
+	}
+	if req.TrackHash != "" {
+		owned, err := file.InUserLibrary(s.DB, claims.Username, req.TrackHash)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check library: %v", err)
+		}
+		if !owned {
+			return nil, status.Errorf(codes.NotFound, "track not found")
+		}
+	}
+
+	// A clock running ahead must not pin its state as the latest forever
+	reportedAt := time.Now()
+	if req.UpdatedAt != nil && req.UpdatedAt.AsTime().Before(reportedAt) {
+		reportedAt = req.UpdatedAt.AsTime()
+	}
+	queue, err := json.Marshal(req.Queue)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode queue: %v", err)
+	}
+
+	state := PlaybackState{
+		Username:   claims.Username,
+		DeviceID:   claims.DeviceID,
+		TrackHash:  req.TrackHash,
+		PositionMs: req.PositionMs,
+		Playing:    req.Playing,
+		Queue:      string(queue),
+		QueueIndex: req.QueueIndex,
+		ReportedAt: reportedAt,
+	}
+	// Reports delivered out of order must not overwrite newer ones
+	err = s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "username"}, {Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"track_hash", "position_ms", "playing", "queue", "queue_index", "reported_at", "updated_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "playback_states.reported_at <= excluded.reported_at"}}},
+	}).Create(&state).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save playback state: %v", err)
+	}
+
+	current, err := s.currentPlayback(claims.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playback state: %v", err)
+	}
+	isCurrent := current != nil && current.DeviceID == claims.DeviceID && current.ReportedAt.Equal(reportedAt)
+	if isCurrent {
+		s.Events.Publish(playbackTopic(claims.Username))
+	}
+	s.touchDevice(ctx, -1)
+
+	return &pb.ReportPlaybackResponse{Current: isCurrent, State: playbackInfo(current)}, nil
+}
+
+func (s *Server) GetPlayback(ctx context.Context, req *emptypb.Empty) (*pb.GetPlaybackResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []PlaybackState
+	if err := s.DB.Where("username = ?", username).Order("reported_at DESC, device_id").Find(&states).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch playback state: %v", err)
+	}
+
+	resp := &pb.GetPlaybackResponse{}
+	for i := range states {
+		resp.Devices = append(resp.Devices, playbackInfo(&states[i]))
+	}
+	if len(states) > 0 {
+		resp.Current = resp.Devices[0]
+	}
+	return resp, nil
+}
+
+func (s *Server) WatchPlayback(req *emptypb.Empty, stream pb.SyncService_WatchPlaybackServer) error {
+	username, err := interceptor.UsernameFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	notify, unsubscribe := s.Events.Subscribe(playbackTopic(username))
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(s.Config.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	var last *PlaybackState
+	for {
+		current, err := s.currentPlayback(username)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to fetch playback state: %v", err)
+		}
+		if current != nil && (last == nil || !current.UpdatedAt.Equal(last.UpdatedAt) || current.DeviceID != last.DeviceID) {
+			err := stream.Send(&pb.WatchPlaybackResponse{Event: &pb.WatchPlaybackResponse_State{State: playbackInfo(current)}})
+			if err != nil {
+				return status.Errorf(codes.Unknown, "failed to send playback state: %v", err)
+			}
+			last = current
+			heartbeat.Reset(s.Config.HeartbeatInterval)
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-notify:
+				waiting = false
+			case <-heartbeat.C:
+				err := stream.Send(&pb.WatchPlaybackResponse{Event: &pb.WatchPlaybackResponse_Heartbeat{Heartbeat: timestamppb.Now()}})
+				if err != nil {
+					return status.Errorf(codes.Unknown, "failed to send heartbeat: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// currentPlayback returns the latest report of any of the user's devices,
+// or nil if there is none.
+func (s *Server) currentPlayback(username string) (*PlaybackState, error) {
+	var state PlaybackState
+	err := s.DB.Where("username = ?", username).Order("reported_at DESC, device_id").First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func playbackInfo(state *PlaybackState) *pb.PlaybackState {
+	if state == nil {
+		return nil
+	}
+	info := &pb.PlaybackState{
+		DeviceId:   state.DeviceID,
+		TrackHash:  state.TrackHash,
+		PositionMs: state.PositionMs,
+		Playing:    state.Playing,
+		QueueIndex: state.QueueIndex,
+		UpdatedAt:  timestamppb.New(state.ReportedAt),
+	}
+	// Stored by ReportPlayback, so it always decodes
+	_ = json.Unmarshal([]byte(state.Queue), &info.Queue)
+	return info
+}
@@ -0,0 +1,99 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxPlaysPerReport    = 1000
+	maxIdempotencyKeyLen = 128
+	// Tolerated clock drift for plays reported as starting in the future
+	maxPlayClockSkew = 5 * time.Minute
+)
+
+func (s *Server) ReportPlays(ctx context.Context, req *pb.ReportPlaysRequest) (*pb.ReportPlaysResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if len(req.Plays) > maxPlaysPerReport {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d plays per call", maxPlaysPerReport)
+	}
+
+	// Plays may refer to tracks removed from the library since, so any track
+	// the user ever had in their library is accepted, including deleted
+	// entries
+	hashes := make([]string, 0, len(req.Plays))
+	for _, p := range req.Plays {
+		hashes = append(hashes, p.TrackHash)
+	}
+	var known []string
+	err := s.DB.Unscoped().Model(&file.LibraryEntry{}).
+		Where("username = ? AND hash IN ?", claims.Username, hashes).Pluck("hash", &known).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up tracks: %v", err)
+	}
+	exists := make(map[string]bool, len(known))
+	for _, h := range known {
+		exists[h] = true
+	}
+
+	resp := &pb.ReportPlaysResponse{}
+	latest := time.Now().Add(maxPlayClockSkew)
+	skips := make(map[string]int32)
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		for _, p := range req.Plays {
+			if p.IdempotencyKey == "" || len(p.IdempotencyKey) > maxIdempotencyKeyLen ||
+				!exists[p.TrackHash] || p.StartedAt == nil || p.StartedAt.AsTime().After(latest) || p.PlayedMs < 0 {
+				resp.RejectedKeys = append(resp.RejectedKeys, p.IdempotencyKey)
+				continue
+			}
+
+			deviceID := claims.DeviceID
+			if deviceID == "" {
+				deviceID = p.DeviceId
+			}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Play{
+				Username:       claims.Username,
+				IdempotencyKey: p.IdempotencyKey,
+				DeviceID:       deviceID,
+				TrackHash:      p.TrackHash,
+				StartedAt:      p.StartedAt.AsTime(),
+				PlayedMs:       p.PlayedMs,
+				Offline:        p.Offline,
+				Skipped:        p.Skipped,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				resp.Duplicates++
+			} else {
+				resp.Accepted++
+				if p.Skipped {
+					skips[p.TrackHash]++
+				}
+			}
+		}
+		// Retried reports are duplicates, so skips are only counted once
+		return countSkips(tx, claims.Username, skips)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save plays: %v", err)
+	}
+
+	if len(skips) > 0 {
+		s.Events.Publish(claims.Username)
+	}
+	s.touchDevice(ctx, -1)
+	return resp, nil
+}
@@ -0,0 +1,323 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/playlist"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+const maxSyncRules = 100
+
+var (
+	ruleActions = map[pb.RuleAction]string{
+		pb.RuleAction_RULE_ACTION_INCLUDE: RuleInclude,
+		pb.RuleAction_RULE_ACTION_EXCLUDE: RuleExclude,
+	}
+	ruleFields = map[pb.RuleField]string{
+		pb.RuleField_RULE_FIELD_ALL:      RuleFieldAll,
+		pb.RuleField_RULE_FIELD_ARTIST:   RuleFieldArtist,
+		pb.RuleField_RULE_FIELD_ALBUM:    RuleFieldAlbum,
+		pb.RuleField_RULE_FIELD_FORMAT:   RuleFieldFormat,
+		pb.RuleField_RULE_FIELD_PLAYLIST: RuleFieldPlaylist,
+	}
+)
+
+func (s *Server) SetSyncRules(ctx context.Context, req *pb.SetSyncRulesRequest) (*pb.SyncRules, error) {
+	username, deviceID, err := ruleTarget(ctx, req.DeviceId)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Rules) > maxSyncRules {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d rules per device", maxSyncRules)
+	}
+	if req.StorageBudget < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "storage_budget must not be negative")
+	}
+
+	rules := make([]SyncRule, len(req.Rules))
+	for i, r := range req.Rules {
+		action, ok := ruleActions[r.Action]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "rule %d: action is required", i)
+		}
+		field, ok := ruleFields[r.Field]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "rule %d: unsupported field %s", i, r.Field)
+		}
+		if field != RuleFieldAll && r.Value == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "rule %d: value is required", i)
+		}
+		if r.MaxSize < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "rule %d: max_size must not be negative", i)
+		}
+		rules[i] = SyncRule{
+			Username: username,
+			DeviceID: deviceID,
+			Position: i,
+			Action:   action,
+			Field:    field,
+			Value:    r.Value,
+			MaxSize:  r.MaxSize,
+		}
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ? AND device_id = ?", username, deviceID).Delete(&SyncRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) > 0 {
+			if err := tx.Create(&rules).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&DeviceSyncSettings{
+			Username:      username,
+			DeviceID:      deviceID,
+			StorageBudget: req.StorageBudget,
+			ResyncPending: true,
+		}).Error
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save sync rules: %v", err)
+	}
+
+	return syncRulesResponse(deviceID, rules, req.StorageBudget), nil
+}
+
+func (s *Server) GetSyncRules(ctx context.Context, req *pb.GetSyncRulesRequest) (*pb.SyncRules, error) {
+	username, deviceID, err := ruleTarget(ctx, req.DeviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, settings, err := s.loadRules(username, deviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch sync rules: %v", err)
+	}
+	return syncRulesResponse(deviceID, rules, settings.StorageBudget), nil
+}
+
+// ruleTarget returns the caller and the device a rules call is about: the
+// requested one, or the calling device.
+func ruleTarget(ctx context.Context, deviceID string) (string, string, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return "", "", status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	if deviceID == "" {
+		deviceID = claims.DeviceID
+	}
+	if deviceID == "" {
+		return "", "", status.Errorf(codes.InvalidArgument, "device_id is required without a device-scoped token")
+	}
+	return claims.Username, deviceID, nil
+}
+
+func syncRulesResponse(deviceID string, rules []SyncRule, budget int64) *pb.SyncRules {
+	resp := &pb.SyncRules{DeviceId: deviceID, StorageBudget: budget}
+	for _, r := range rules {
+		rule := &pb.SyncRule{Id: uint64(r.ID), Value: r.Value, MaxSize: r.MaxSize}
+		for k, v := range ruleActions {
+			if v == r.Action {
+				rule.Action = k
+			}
+		}
+		for k, v := range ruleFields {
+			if v == r.Field {
+				rule.Field = k
+			}
+		}
+		resp.Rules = append(resp.Rules, rule)
+	}
+	return resp
+}
+
+func (s *Server) loadRules(username, deviceID string) ([]SyncRule, DeviceSyncSettings, error) {
+	var rules []SyncRule
+	err := s.DB.Where("username = ? AND device_id = ?", username, deviceID).Order("position").Find(&rules).Error
+	if err != nil {
+		return nil, DeviceSyncSettings{}, err
+	}
+	var settings DeviceSyncSettings
+	err = s.DB.Where("username = ? AND device_id = ?", username, deviceID).Limit(1).Find(&settings).Error
+	return rules, settings, err
+}
+
+// selection is the resolved set of tracks for a device, mapping each
+// selected hash to the ID of the rule that selected it.
+type selection map[string]uint
+
+// sizedTrack is a track with the size of its blob.
+type sizedTrack struct {
+	file.Track
+	Size int64
+}
+
+// sizedLibrary returns the playable tracks in the user's library with the
+// size of their blobs.
+func (s *Server) sizedLibrary(username string) ([]sizedTrack, error) {
+	var tracks []sizedTrack
+	err := s.DB.Model(&file.Track{}).Scopes(file.InLibrary(username), file.Playable).
+		Joins("LEFT JOIN blobs ON blobs.hash = tracks.hash").
+		Select("tracks.*, COALESCE(blobs.size, 0) AS size").
+		Order("tracks.id").Find(&tracks).Error
+	return tracks, err
+}
+
+// selectTracks resolves the sync rules of a device against the user's
+// library. It returns nil if the device has no rules, meaning everything
+// is synced.
+func (s *Server) selectTracks(username, deviceID string) (selection, error) {
+	return s.selectFrom(username, deviceID, nil)
+}
+
+// selectFrom is selectTracks against tracks returned by sizedLibrary, so
+// callers resolving several devices load the library once. A nil library
+// is loaded when the device has rules.
+func (s *Server) selectFrom(username, deviceID string, tracks []sizedTrack) (selection, error) {
+	if deviceID == "" {
+		return nil, nil
+	}
+	rules, settings, err := s.loadRules(username, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 && settings.StorageBudget == 0 {
+		return nil, nil
+	}
+
+	if tracks == nil {
+		if tracks, err = s.sizedLibrary(username); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without rules a budget applies to the whole library
+	if len(rules) == 0 {
+		rules = []SyncRule{{Action: RuleInclude, Field: RuleFieldAll}}
+	}
+
+	// Playlist rules match against the playlist's current contents
+	members := make(map[uint]map[string]bool)
+	for _, rule := range rules {
+		if rule.Field != RuleFieldPlaylist {
+			continue
+		}
+		hashes, err := playlist.Hashes(s.DB, username, rule.Value)
+		if err != nil {
+			return nil, err
+		}
+		members[rule.ID] = make(map[string]bool, len(hashes))
+		for _, h := range hashes {
+			members[rule.ID][h] = true
+		}
+	}
+
+	type candidate struct {
+		track    *sizedTrack
+		position int
+		ruleID   uint
+	}
+	var candidates []candidate
+	for i := range tracks {
+		for _, rule := range rules {
+			if !rule.matches(&tracks[i], members[rule.ID]) {
+				continue
+			}
+			if rule.Action == RuleInclude {
+				candidates = append(candidates, candidate{&tracks[i], rule.Position, rule.ID})
+			}
+			break
+		}
+	}
+
+	// Fill the budget in rule priority order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].position < candidates[j].position
+	})
+	selected := make(selection, len(candidates))
+	var used int64
+	for _, c := range candidates {
+		if settings.StorageBudget > 0 {
+			if used+c.track.Size > settings.StorageBudget {
+				continue // Smaller files further down may still fit
+			}
+			used += c.track.Size
+		}
+		selected[c.track.Hash] = c.ruleID
+	}
+	return selected, nil
+}
+
+// matches reports whether the rule selects t; inPlaylist holds the hashes of
+// the rule's playlist for playlist rules.
+func (r *SyncRule) matches(t *sizedTrack, inPlaylist map[string]bool) bool {
+	if r.MaxSize > 0 && t.Size > r.MaxSize {
+		return false
+	}
+	switch r.Field {
+	case RuleFieldAll:
+		return true
+	case RuleFieldArtist:
+		return strings.EqualFold(strings.TrimSpace(t.Artist), strings.TrimSpace(r.Value))
+	case RuleFieldAlbum:
+		return strings.EqualFold(strings.TrimSpace(t.Album), strings.TrimSpace(r.Value))
+	case RuleFieldFormat:
+		return strings.EqualFold(t.Format, r.Value)
+	case RuleFieldPlaylist:
+		return inPlaylist[t.Hash]
+	}
+	return false
+}
+
+// playlistRules returns the IDs of the playlists the device's rules select
+// tracks by.
+func (s *Server) playlistRules(username, deviceID string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	if deviceID == "" {
+		return ids, nil
+	}
+	var values []string
+	err := s.DB.Model(&SyncRule{}).
+		Where("username = ? AND device_id = ? AND field = ?", username, deviceID, RuleFieldPlaylist).
+		Pluck("value", &values).Error
+	for _, v := range values {
+		ids[v] = true
+	}
+	return ids, err
+}
+
+// resyncPending reports whether the device's rules changed since it last
+// did a full sync.
+func (s *Server) resyncPending(username, deviceID string) (bool, error) {
+	if deviceID == "" {
+		return false, nil
+	}
+	var settings DeviceSyncSettings
+	err := s.DB.Where("username = ? AND device_id = ?", username, deviceID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return settings.ResyncPending, err
+}
+
+// storageBudgeted reports whether the device's selection is capped by a
+// storage budget.
+func (s *Server) storageBudgeted(username, deviceID string) (bool, error) {
+	if deviceID == "" {
+		return false, nil
+	}
+	var count int64
+	err := s.DB.Model(&DeviceSyncSettings{}).
+		Where("username = ? AND device_id = ? AND storage_budget > 0", username, deviceID).Count(&count).Error
+	return count > 0, err
+}
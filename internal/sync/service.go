@@ -2,11 +2,11 @@ package sync
 
 import (
 	"context"
-	"path/filepath"
-	"strings"
 
 	"github.com/datapeice/astolfosplayer-backend/internal/config"
 	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
 	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -18,38 +18,78 @@ type Server struct {
 	pb.UnimplementedSyncServiceServer
 	DB     *gorm.DB
 	Config *config.SyncConfig
+	// Events wakes up WatchLibrary streams, keyed by username
+	Events *pubsub.Broker
 }
 
 func (s *Server) GetSync(ctx context.Context, req *emptypb.Empty) (*pb.GetSyncResponse, error) {
+	claims, ok := interceptor.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	username := claims.Username
+
 	var tracks []file.Track
 
 	// We need to access the tracks table. Since we are in a separate microservice,
 	// we share the database schema/models. Ideally, models should be in a shared package.
 	// For now, we import the model from internal/file since they share the same DB (sqlite_data volume).
 
-	// Query all tracks
-	if err := s.DB.Find(&tracks).Error; err != nil {
+	// Taken before the snapshot, so changes racing with it are replayed by
+	// GetChanges rather than lost
+	cursor, err := file.LatestChange(s.DB)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read change log: %v", err)
+	}
+
+	// Query the caller's tracks whose content was detected as audio
+	if err := s.DB.Scopes(file.InLibrary(username), file.Playable).Find(&tracks).Error; err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to fetch tracks: %v", err)
 	}
 
-	supportedExtensions := map[string]bool{
-		".mp3":  true,
-		".flac": true,
-		".wav":  true,
-		".ogg":  true,
-		".m4a":  true,
+	selected, err := s.selectTracks(username, claims.DeviceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to apply sync rules: %v", err)
+	}
+	annotations, err := s.annotationsOf(username, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch annotations: %v", err)
 	}
 
 	var files []*pb.FileInfo
-	for _, t := range tracks {
-		ext := strings.ToLower(filepath.Ext(t.Filename))
-		if supportedExtensions[ext] {
-			files = append(files, &pb.FileInfo{
-				Hash:     t.Hash,
-				Filename: t.Filename,
-			})
+	for i := range tracks {
+		info := fileInfo(&tracks[i])
+		info.Annotation = annotations[info.Hash]
+		if selected != nil {
+			ruleID, ok := selected[info.Hash]
+			if !ok {
+				continue
+			}
+			info.RuleId = uint64(ruleID)
 		}
+		files = append(files, info)
 	}
 
-	return &pb.GetSyncResponse{Files: files}, nil
+	if claims.DeviceID != "" {
+		// The device now holds a snapshot matching its current rules
+		err := s.DB.Model(&DeviceSyncSettings{}).Where("username = ? AND device_id = ?", username, claims.DeviceID).
+			Update("resync_pending", false).Error
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update sync settings: %v", err)
+		}
+	}
+	s.touchDevice(ctx, int64(cursor))
+
+	return &pb.GetSyncResponse{Files: files, Cursor: int64(cursor)}, nil
+}
+
+func fileInfo(t *file.Track) *pb.FileInfo {
+	return &pb.FileInfo{
+		Hash:        t.Hash,
+		Filename:    t.Filename,
+		AlbumId:     t.AlbumID,
+		ArtworkHash: t.ArtworkHash,
+		Format:      t.Format,
+		MimeType:    t.MIMEType,
+	}
 }
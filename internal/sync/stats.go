@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultChartLimit = 10
+	maxChartLimit     = 500
+	maxStatsHashes    = 5000
+	summaryChartLimit = 5
+)
+
+func (s *Server) GetTrackStats(ctx context.Context, req *pb.GetTrackStatsRequest) (*pb.GetTrackStatsResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Hashes) > maxStatsHashes {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d hashes per call", maxStatsHashes)
+	}
+
+	var rows []struct {
+		TrackHash    string
+		PlayCount    int64
+		PlayedMs     int64
+		LastPlayedAt string
+	}
+	err = s.DB.Model(&Play{}).
+		Select("track_hash, COUNT(*) AS play_count, SUM(played_ms) AS played_ms, MAX(started_at) AS last_played_at").
+		Where("username = ? AND track_hash IN ?", username, req.Hashes).
+		Group("track_hash").Scan(&rows).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch play stats: %v", err)
+	}
+	byHash := make(map[string]*pb.TrackStats, len(rows))
+	for _, r := range rows {
+		stats := &pb.TrackStats{Hash: r.TrackHash, PlayCount: r.PlayCount, PlayedMs: r.PlayedMs}
+		// MAX() loses the column type, so the timestamp comes back as text
+		if t, err := parseSQLiteTime(r.LastPlayedAt); err == nil {
+			stats.LastPlayedAt = timestamppb.New(t)
+		}
+		byHash[r.TrackHash] = stats
+	}
+
+	resp := &pb.GetTrackStatsResponse{}
+	for _, hash := range req.Hashes {
+		stats, ok := byHash[hash]
+		if !ok {
+			stats = &pb.TrackStats{Hash: hash}
+		}
+		resp.Stats = append(resp.Stats, stats)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetTopCharts(ctx context.Context, req *pb.GetTopChartsRequest) (*pb.GetTopChartsResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultChartLimit
+	}
+	if limit > maxChartLimit {
+		limit = maxChartLimit
+	}
+
+	query := s.playsOf(username)
+	if req.From != nil {
+		query = query.Where("plays.started_at >= ?", req.From.AsTime())
+	}
+	if req.To != nil {
+		query = query.Where("plays.started_at < ?", req.To.AsTime())
+	}
+
+	entries, err := topChart(query, req.Kind, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetTopChartsResponse{Entries: entries}, nil
+}
+
+func (s *Server) GetYearSummary(ctx context.Context, req *pb.GetYearSummaryRequest) (*pb.GetYearSummaryResponse, error) {
+	username, err := interceptor.UsernameFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Year < 1970 || req.Year > 9999 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid year %d", req.Year)
+	}
+
+	start := time.Date(int(req.Year), time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	inYear := func() *gorm.DB {
+		return s.playsOf(username).Where("plays.started_at >= ? AND plays.started_at < ?", start, end)
+	}
+
+	resp := &pb.GetYearSummaryResponse{Year: req.Year, PlaysPerMonth: make([]int64, 12)}
+	var totals struct {
+		PlayCount      int64
+		PlayedMs       int64
+		DistinctTracks int64
+	}
+	err = inYear().Select("COUNT(*) AS play_count, COALESCE(SUM(plays.played_ms), 0) AS played_ms, COUNT(DISTINCT plays.track_hash) AS distinct_tracks").
+		Scan(&totals).Error
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to summarize plays: %v", err)
+	}
+	resp.PlayCount, resp.PlayedMs, resp.DistinctTracks = totals.PlayCount, totals.PlayedMs, totals.DistinctTracks
+
+	for month := range 12 {
+		from := start.AddDate(0, month, 0)
+		err := s.playsOf(username).Where("plays.started_at >= ? AND plays.started_at < ?", from, from.AddDate(0, 1, 0)).
+			Count(&resp.PlaysPerMonth[month]).Error
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count plays: %v", err)
+		}
+	}
+
+	if resp.TopTracks, err = topChart(inYear(), pb.ChartKind_CHART_KIND_TRACKS, summaryChartLimit); err != nil {
+		return nil, err
+	}
+	if resp.TopArtists, err = topChart(inYear(), pb.ChartKind_CHART_KIND_ARTISTS, summaryChartLimit); err != nil {
+		return nil, err
+	}
+	if resp.TopAlbums, err = topChart(inYear(), pb.ChartKind_CHART_KIND_ALBUMS, summaryChartLimit); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// playsOf selects the user's plays joined with the metadata of their
+// tracks, including tracks deleted since.
+func (s *Server) playsOf(username string) *gorm.DB {
+	return s.DB.Model(&Play{}).
+		Joins("JOIN tracks ON tracks.hash = plays.track_hash").
+		Where("plays.username = ?", username)
+}
+
+// topChart ranks the plays selected by query by play count.
+func topChart(query *gorm.DB, kind pb.ChartKind, limit int) ([]*pb.ChartEntry, error) {
+	switch kind {
+	case pb.ChartKind_CHART_KIND_TRACKS:
+		query = query.Select("plays.track_hash AS hash, MAX(tracks.title) AS title, MAX(tracks.artist) AS artist, MAX(tracks.album) AS album, COUNT(*) AS play_count, SUM(plays.played_ms) AS played_ms").
+			Group("plays.track_hash")
+	case pb.ChartKind_CHART_KIND_ARTISTS:
+		query = query.Select("MAX(tracks.artist) AS artist, COUNT(*) AS play_count, SUM(plays.played_ms) AS played_ms").
+			Where("tracks.artist <> ''").Group("LOWER(tracks.artist)")
+	case pb.ChartKind_CHART_KIND_ALBUMS:
+		query = query.Select("tracks.album_id AS album_id, MAX(tracks.album) AS album, MAX(tracks.artist) AS artist, COUNT(*) AS play_count, SUM(plays.played_ms) AS played_ms").
+			Where("tracks.album_id <> ''").Group("tracks.album_id")
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "kind is required")
+	}
+
+	var rows []struct {
+		Hash      string
+		AlbumID   string
+		Title     string
+		Artist    string
+		Album     string
+		PlayCount int64
+		PlayedMs  int64
+	}
+	if err := query.Order("play_count DESC, played_ms DESC").Limit(limit).Scan(&rows).Error; err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to rank plays: %v", err)
+	}
+
+	entries := make([]*pb.ChartEntry, 0, len(rows))
+	for _, r := range rows {
+		entries = append(entries, &pb.ChartEntry{
+			Hash:      r.Hash,
+			AlbumId:   r.AlbumID,
+			Title:     r.Title,
+			Artist:    r.Artist,
+			Album:     r.Album,
+			PlayCount: r.PlayCount,
+			PlayedMs:  r.PlayedMs,
+		})
+	}
+	return entries, nil
+}
+
+// parseSQLiteTime parses a timestamp as stored by the SQLite driver.
+func parseSQLiteTime(value string) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04:05.999999999-07:00", value)
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/datapeice/astolfosplayer-backend/internal/file"
+	"github.com/datapeice/astolfosplayer-backend/internal/interceptor"
+	"github.com/datapeice/astolfosplayer-backend/internal/pubsub"
+	pb "github.com/datapeice/astolfosplayer-backend/protos/gen/go/sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+func (s *Server) WatchLibrary(req *pb.WatchLibraryRequest, stream pb.SyncService_WatchLibraryServer) error {
+	claims, ok := interceptor.ClaimsFromContext(stream.Context())
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	username := claims.Username
+
+	// Subscribe before catching up so nothing published in between is missed
+	notify, unsubscribe := s.Events.Subscribe(username)
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(s.Config.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	cursor := req.Cursor
+	for {
+		resp, err := s.changesSince(username, claims.DeviceID, cursor, maxChangesLimit)
+		if err != nil {
+			return err
+		}
+		if resp.ResyncRequired || len(resp.Changes) > 0 || len(resp.PlaylistChanges) > 0 {
+			if err := stream.Send(&pb.WatchLibraryResponse{Event: &pb.WatchLibraryResponse_Changes{Changes: resp}}); err != nil {
+				return status.Errorf(codes.Unknown, "failed to send changes: %v", err)
+			}
+			if resp.ResyncRequired {
+				return nil
+			}
+			heartbeat.Reset(s.Config.HeartbeatInterval)
+		}
+		cursor = resp.Cursor
+		s.touchDevice(stream.Context(), cursor)
+		if resp.HasMore {
+			continue
+		}
+
+		// Wait for a change, sending heartbeats while idle
+		for waiting := true; waiting; {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-notify:
+				waiting = false
+			case <-heartbeat.C:
+				err := stream.Send(&pb.WatchLibraryResponse{Event: &pb.WatchLibraryResponse_Heartbeat{Heartbeat: &pb.Heartbeat{Cursor: cursor}}})
+				if err != nil {
+					return status.Errorf(codes.Unknown, "failed to send heartbeat: %v", err)
+				}
+				s.touchDevice(stream.Context(), -1)
+			}
+		}
+	}
+}
+
+// PollChanges watches the change log for writes made by other processes,
+// usually the File service, and publishes the affected usernames to events
+// every interval until ctx is cancelled. One poller serves all streams.
+func PollChanges(ctx context.Context, db *gorm.DB, events *pubsub.Broker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, err := file.LatestChange(db)
+	if err != nil {
+		log.Printf("Failed to read change log: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var changes []file.Change
+			err := db.Model(&file.Change{}).Select("username, MAX(id) AS id").
+				Where("id > ?", last).Group("username").Find(&changes).Error
+			if err != nil {
+				log.Printf("Failed to poll change log: %v", err)
+				continue
+			}
+			for _, c := range changes {
+				last = max(last, c.ID)
+				events.Publish(c.Username)
+			}
+		}
+	}
+}